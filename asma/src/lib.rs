@@ -2,8 +2,11 @@ extern crate web_sys;
 use aes::Aes256;
 use block_modes::block_padding::Pkcs7;
 use block_modes::{BlockMode, Cbc};
+use brotli_decompressor::Decompressor;
+use flate2::read::GzDecoder;
 use md5::compute as md5_digest;
 use std::collections::HashMap;
+use std::io::Read;
 use wasm_bindgen::prelude::*;
 
 // macro_rules! log {
@@ -14,6 +17,14 @@ use wasm_bindgen::prelude::*;
 
 type Aes256Cbc = Cbc<Aes256, Pkcs7>;
 
+// Plaintexts starting with the magic are envelopes flagging how they were compressed, see `src/rproxy/envelope.go`:
+// magic (3 bytes), version (1 byte), compression (1 byte: 0 for none, 1 for gzip and 2 for brotli) and the plaintext
+const ENVELOPE_MAGIC: [u8; 3] = [0xff, b'R', b'P'];
+const ENVELOPE_VERSION: u8 = 1;
+const ENVELOPE_HEADER_SIZE: usize = 5;
+// How large compressed plaintexts are allowed to get once decompressed, the same as `DefaultMaxDecompressedSize` in Go
+const MAX_DECOMPRESSED_SIZE: u64 = 64 << 20;
+
 #[wasm_bindgen]
 pub fn build_info() -> JsValue {
     let mut hm = HashMap::new();
@@ -54,10 +65,39 @@ pub fn proxy(payload_with_iv: Box<[u8]>, raw_key: &str) -> Result<String, JsErro
     let iv = payload_with_iv[..16].to_vec();
     let data = payload_with_iv[16..].to_vec();
 
-    let decrypted = decrypt_aes256(&final_key.as_bytes(), &iv, &data);
+    let decrypted = open_envelope(decrypt_aes256(&final_key.as_bytes(), &iv, &data))?;
     return Ok(String::from_utf8(decrypted).unwrap());
 }
 
+// Plaintexts without an envelope are returned as they are, since the proxy only wraps them when compression is enabled
+fn open_envelope(payload: Vec<u8>) -> Result<Vec<u8>, JsError> {
+    if !payload.starts_with(&ENVELOPE_MAGIC) {
+        return Ok(payload);
+    }
+    if payload.len() < ENVELOPE_HEADER_SIZE {
+        return Err(JsError::new("Invalid envelope header length"));
+    }
+    if payload[ENVELOPE_MAGIC.len()] != ENVELOPE_VERSION {
+        return Err(JsError::new("Unsupported envelope version"));
+    }
+
+    let body = &payload[ENVELOPE_HEADER_SIZE..];
+    let mut output = Vec::new();
+    // Reading a byte past the limit tells payloads that decompress into huge ones apart from the ones right at it
+    let limit = MAX_DECOMPRESSED_SIZE + 1;
+    match payload[ENVELOPE_MAGIC.len() + 1] {
+        0 => return Ok(body.to_vec()),
+        1 => GzDecoder::new(body).take(limit).read_to_end(&mut output),
+        2 => Decompressor::new(body, 4096).take(limit).read_to_end(&mut output),
+        _ => return Err(JsError::new("Unsupported compression")),
+    }
+    .map_err(|e| JsError::new(&e.to_string()))?;
+    if output.len() as u64 > MAX_DECOMPRESSED_SIZE {
+        return Err(JsError::new("Decompressed payload is larger than allowed"));
+    }
+    return Ok(output);
+}
+
 fn decrypt_aes256(key: &[u8], iv: &[u8], data: &[u8]) -> Vec<u8> {
     let mut encrypted_data = data.clone().to_owned();
     let cipher = Aes256Cbc::new_from_slices(&key, &iv).unwrap();
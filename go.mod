@@ -1,13 +1,15 @@
 module fundamentei.io/rproxy
 
-go 1.18
+go 1.22
 
 require (
 	github.com/BurntSushi/toml v1.2.0
 	github.com/NYTimes/gziphandler v1.1.1
+	github.com/andybalholm/brotli v1.0.4
 	github.com/aws/aws-lambda-go v1.34.1
 	github.com/awslabs/aws-lambda-go-api-proxy v0.13.3
 	github.com/gobwas/glob v0.2.3
+	github.com/klauspost/compress v1.18.0
 	github.com/rs/cors v1.8.2
 	github.com/samber/lo v1.27.0
 )
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"fundamentei.io/rproxy/src/rproxy"
+)
+
+// emulateLambda is for running Lambda events through the same handler used on AWS Lambda, without being on it. Events
+// are read from stdin (one or more JSON documents), a file or a directory of `.json` fixtures, and the resulting
+// response events are printed to stdout, one per line
+func emulateLambda(args []string) error {
+	return runLambdaEmulation(args, os.Stdout)
+}
+
+// runLambdaEmulation is for running the `lambda-emulate` command with the response events written to the given writer
+func runLambdaEmulation(args []string, w io.Writer) error {
+	fs := newFlagSet("lambda-emulate")
+	cfgFile := fs.String("config", "", "Path to the config file (defaults to config.toml)")
+	format := fs.String("format", "", "Overrides general.lambdaEventFormat from the config file")
+	events := fs.String("events", "-", "File or directory of .json files to read the events from, \"-\" means stdin")
+	pretty := fs.Bool("pretty", false, "Indents the printed response events")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, _, err := loadConfig(*cfgFile)
+	if err != nil {
+		return err
+	}
+	if err := cfg.ValidateLambda(); err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = cfg.General.LambdaEventFormat
+	}
+	proxy, err := rproxy.NewHandler(cfg)
+	if err != nil {
+		return err
+	}
+	lambdaHandler, err := rproxy.NewLambdaHandler(proxy, *format)
+	if err != nil {
+		return err
+	}
+
+	out := json.NewEncoder(w)
+	if *pretty {
+		out.SetIndent("", "  ")
+	}
+	return forEachLambdaEvent(*events, func(source string, event json.RawMessage) error {
+		log.Printf("Invoking with the event from %s", source)
+		res, err := lambdaHandler(context.Background(), event)
+		if err != nil {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+		return out.Encode(res)
+	})
+}
+
+// forEachLambdaEvent is for calling fn with every event found in the given path
+func forEachLambdaEvent(path string, fn func(source string, event json.RawMessage) error) error {
+	if path == "-" {
+		return decodeLambdaEvents("stdin", os.Stdin, fn)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*.json")); err != nil {
+			return err
+		}
+		sort.Strings(files)
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		err = decodeLambdaEvents(file, f, fn)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeLambdaEvents(source string, r io.Reader, fn func(source string, event json.RawMessage) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var event json.RawMessage
+		if err := dec.Decode(&event); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+		if err := fn(source, event); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fundamentei.io/rproxy/src/rproxy"
+)
+
+const lambdaFixturesDir = "src/rproxy/testdata/lambda"
+
+// lambdaResponseEvent holds what's common to the response events of every format
+type lambdaResponseEvent struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+func (e *lambdaResponseEvent) header(name string) string {
+	if value, ok := e.Headers[name]; ok {
+		return value
+	}
+	return strings.Join(e.MultiValueHeaders[name], ",")
+}
+
+// writeLambdaFixtures is for copying the fixtures into a temporary directory, with their destination pointing to the
+// given URL instead of httpbin.org, so the emulation doesn't depend on the network
+func writeLambdaFixtures(t *testing.T, destination string) (string, int) {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(lambdaFixturesDir, "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("expected to find the fixtures: %v", err)
+	}
+	// Destinations go in the path either as is, URL-encoded or base64-encoded
+	encode := base64.RawURLEncoding.EncodeToString
+	replacer := strings.NewReplacer(
+		"https://httpbin.org", destination,
+		url.QueryEscape("https://httpbin.org"), url.QueryEscape(destination),
+		encode([]byte("https://httpbin.org/anything")), encode([]byte(destination+"/anything")),
+	)
+	dir := t.TempDir()
+	for _, file := range files {
+		event, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, filepath.Base(file)), []byte(replacer.Replace(string(event))), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, len(files)
+}
+
+func TestLambdaEmulate(t *testing.T) {
+	const sharedKey = "shared"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/anything" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+		if body, _ := io.ReadAll(r.Body); string(body) != `{"hello":"world"}` {
+			t.Errorf("unexpected body: %q", body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer upstream.Close()
+
+	cfgFile := filepath.Join(t.TempDir(), "config.toml")
+	cfg := fmt.Sprintf(`[general]
+allowedHosts = ["127.0.0.1:*"]
+allowedMethods = ["POST"]
+isEncryptedHeaderKey = "X-Fndm-Is-Encrypted"
+sharedKey = %q
+
+[limits]
+maxRequestSizeInKb = 10
+maxResponseSizeInKb = 10
+`, sharedKey)
+	if err := os.WriteFile(cfgFile, []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	events, count := writeLambdaFixtures(t, upstream.URL)
+	var out bytes.Buffer
+	if err := runLambdaEmulation([]string{"--config", cfgFile, "--events", events}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	dec := json.NewDecoder(&out)
+	for i := 0; i < count; i++ {
+		var res lambdaResponseEvent
+		if err := dec.Decode(&res); err != nil {
+			t.Fatalf("expected %d response events, got %d: %v", count, i, err)
+		}
+		if res.StatusCode != http.StatusCreated {
+			t.Errorf("event %d: expected status %d, got %d", i, http.StatusCreated, res.StatusCode)
+		}
+		if encrypted := res.header("X-Fndm-Is-Encrypted"); encrypted != "true" {
+			t.Errorf("event %d: expected the response to be encrypted, got %q", i, encrypted)
+		}
+		if !res.IsBase64Encoded {
+			t.Errorf("event %d: expected the body to be base64 encoded", i)
+			continue
+		}
+		payload, err := base64.StdEncoding.DecodeString(res.Body)
+		if err != nil {
+			t.Errorf("event %d: %v", i, err)
+			continue
+		}
+		if body, err := rproxy.Decrypt("Bearer token", sharedKey, payload); err != nil || string(body) != `{"ok":true}` {
+			t.Errorf("event %d: unexpected body: %q (%v)", i, body, err)
+		}
+	}
+	if dec.More() {
+		t.Errorf("expected exactly %d response events", count)
+	}
+}
@@ -1,66 +1,104 @@
 package main
 
 import (
-	"encoding/base64"
+	"flag"
 	"fmt"
 	"log"
-	"net"
-	"net/http"
-	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"fundamentei.io/rproxy/src/rproxy"
-	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/awslabs/aws-lambda-go-api-proxy/httpadapter"
 )
 
 var (
 	// https://docs.aws.amazon.com/lambda/latest/dg/configuration-envvars.html#configuration-envvars-runtime
 	isRunningInLambda = strings.HasPrefix(os.Getenv("AWS_EXECUTION_ENV"), "AWS_Lambda")
+	// Is set at build time through `-ldflags="-X main.version=..."`
+	version = "dev"
 )
 
+type command struct {
+	name        string
+	description string
+	run         func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	// Declared here to avoid an initialization cycle since `usage` refers to `commands`
+	commands = []command{
+		{"serve", "Runs the proxy (default when no command is given)", serve},
+		{"check-config", "Loads and validates a config file", checkConfig},
+		{"encrypt", "Encrypts a payload the same way the proxy encrypts its responses", encrypt},
+		{"decrypt", "Decrypts a proxy response the same way the asma VM does", decrypt},
+		{"lambda-emulate", "Runs Lambda events from stdin or fixtures through the Lambda handler", emulateLambda},
+		{"keygen", "Generates a new shared key or API key", keygen},
+		{"version", "Prints version information", printVersion},
+	}
+}
+
 func main() {
-	if err := run(); err != nil {
+	// The flag sets already print the usage of the command when help is requested
+	if err := run(os.Args[1:]); err != nil && err != flag.ErrHelp {
 		log.Fatal(err)
 	}
 }
 
-func run() error {
-	cfgFile := "config.toml"
-	// If we're on AWS Lambda, loads the config from the appropriate file.
-	if isRunningInLambda {
-		if _, err := os.Stat("config.production.toml"); err == nil {
-			cfgFile = "config.production.toml"
-		} else {
-			warnAboutMissingProductionConfigFile()
-		}
+func run(args []string) error {
+	// Running without a command (or straight with flags) is the same as `serve`, which is what happens on AWS Lambda
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return serve(args)
 	}
-	cfg, err := rproxy.NewConfigFromFile(cfgFile)
-	if err != nil {
-		return err
-	}
-
-	warnIfMissingSharedKey(cfg)
-	proxy := rproxy.NewHandler(cfg)
-
-	if isRunningInLambda {
-		lambda.Start(httpadapter.NewV2(proxy).ProxyWithContext)
+	if args[0] == "help" {
+		usage()
 		return nil
 	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+	usage()
+	return fmt.Errorf("unknown command %q", args[0])
+}
 
-	// Make sure the provided config is valid by trying to parse it
-	if _, _, err := net.SplitHostPort(cfg.General.Listen); err != nil {
-		return err
+func usage() {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", name)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", cmd.name, cmd.description)
 	}
+	fmt.Fprintf(os.Stderr, "\nRun `%s <command> -h` to see the flags of a command.\n", name)
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
 
-	l, err := net.Listen("tcp", cfg.General.Listen)
+// loadConfig is for loading and validating the config file. When no path is given it falls back to `config.toml`, or
+// `config.production.toml` if we're running on AWS Lambda
+func loadConfig(cfgFile string) (*rproxy.Config, string, error) {
+	if cfgFile == "" {
+		cfgFile = "config.toml"
+		// If we're on AWS Lambda, loads the config from the appropriate file.
+		if isRunningInLambda {
+			if _, err := os.Stat("config.production.toml"); err == nil {
+				cfgFile = "config.production.toml"
+			} else {
+				warnAboutMissingProductionConfigFile()
+			}
+		}
+	}
+	cfg, err := rproxy.NewConfigFromFile(cfgFile)
 	if err != nil {
-		return err
+		return nil, cfgFile, err
 	}
-
-	printListenInfo(cfg, l.Addr())
-	return http.Serve(l, proxy)
+	if err := cfg.Validate(); err != nil {
+		return nil, cfgFile, err
+	}
+	return cfg, cfgFile, nil
 }
 
 func warnAboutMissingProductionConfigFile() {
@@ -83,25 +121,3 @@ func warnIfMissingSharedKey(cfg *rproxy.Config) {
 		)
 	}
 }
-
-func printListenInfo(cfg *rproxy.Config, addr net.Addr) {
-	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
-		ip := tcpAddr.IP.String()
-		if ip == "::" {
-			ip = "127.0.0.1"
-		}
-
-		httpURL := fmt.Sprintf("http://%s:%d", ip, tcpAddr.Port)
-		httpbinURL := "https://httpbin.org/json"
-
-		log.Printf("Listening on %s", httpURL)
-		log.Println("Try making a request to any of the following URLs:")
-		for exampleID, exampleURL := range []string{
-			httpbinURL,
-			url.QueryEscape(httpbinURL),
-			base64.RawURLEncoding.EncodeToString([]byte(httpbinURL)),
-		} {
-			log.Printf("\t%d. %s/%s", exampleID+1, httpURL, exampleURL)
-		}
-	}
-}
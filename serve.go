@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"fundamentei.io/rproxy/src/rproxy"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// How often the config file is checked for changes when `general.watchConfig` is enabled
+const configWatchInterval = 5 * time.Second
+
+func serve(args []string) error {
+	fs := newFlagSet("serve")
+	cfgFile := fs.String("config", "", "Path to the config file (defaults to config.toml)")
+	listen := fs.String("listen", "", "Overrides general.listen from the config file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, cfgPath, err := loadConfig(*cfgFile)
+	if err != nil {
+		return err
+	}
+
+	warnIfMissingSharedKey(cfg)
+
+	if isRunningInLambda {
+		if err := cfg.ValidateLambda(); err != nil {
+			return err
+		}
+		proxy, err := rproxy.NewHandler(cfg)
+		if err != nil {
+			return err
+		}
+		lambdaHandler, err := rproxy.NewLambdaHandler(proxy, cfg.General.LambdaEventFormat)
+		if err != nil {
+			return err
+		}
+		lambda.Start(lambdaHandler)
+		return nil
+	}
+
+	listenAddr := cfg.General.Listen
+	if *listen != "" {
+		listenAddr = *listen
+	}
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+
+	proxy, err := rproxy.NewReloadableHandler(cfgPath, cfg)
+	if err != nil {
+		return err
+	}
+	reloadOnSignal(proxy)
+	if cfg.General.WatchConfig {
+		go proxy.WatchFile(context.Background(), configWatchInterval)
+	}
+
+	srv, err := rproxy.NewServer(cfg, proxy)
+	if err != nil {
+		return err
+	}
+
+	printListenInfo(l.Addr(), rproxy.IfTrueElse(srv.IsTLS(), "https", "http"))
+	return serveUntilSignaled(srv, l)
+}
+
+// serveUntilSignaled is for serving until the process is asked to stop, shutting the server down gracefully
+func serveUntilSignaled(srv *rproxy.Server, l net.Listener) error {
+	// The usage counted since the last periodic flush would be lost otherwise, even more so when the server failed
+	defer func() {
+		if err := rproxy.CloseQuotaStores(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(l)
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-stop:
+		log.Printf("Received %s, shutting down", sig)
+		// A second signal skips the graceful shutdown
+		signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+		if err := srv.Shutdown(); err != nil {
+			return err
+		}
+		log.Println("Shut down gracefully")
+		return nil
+	}
+}
+
+// reloadOnSignal is for reloading the config whenever the process receives a SIGHUP
+func reloadOnSignal(proxy *rproxy.ReloadableHandler) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("Received SIGHUP, reloading the config")
+			if err := proxy.Reload(); err != nil {
+				log.Print(err)
+			}
+		}
+	}()
+}
+
+func printListenInfo(addr net.Addr, scheme string) {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip := tcpAddr.IP.String()
+		if ip == "::" {
+			ip = "127.0.0.1"
+		}
+
+		httpURL := fmt.Sprintf("%s://%s:%d", scheme, ip, tcpAddr.Port)
+		httpbinURL := "https://httpbin.org/json"
+
+		log.Printf("Listening on %s", httpURL)
+		log.Println("Try making a request to any of the following URLs:")
+		for exampleID, exampleURL := range []string{
+			httpbinURL,
+			url.QueryEscape(httpbinURL),
+			base64.RawURLEncoding.EncodeToString([]byte(httpbinURL)),
+		} {
+			log.Printf("\t%d. %s/%s", exampleID+1, httpURL, exampleURL)
+		}
+	}
+}
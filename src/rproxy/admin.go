@@ -0,0 +1,74 @@
+package rproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// withAdmin is for serving the admin endpoints under the configured path, which require the admin token as a bearer
+// token. Everything else goes to the proxy
+//
+//	GET    <path>/quotas             Usage of everyone
+//	GET    <path>/quotas/<subject>   Usage of a single user
+//	DELETE <path>/quotas/<subject>   Resets the usage of a single user
+//	GET    <path>/origin-rejections  How many requests each origin rule has turned down
+func (h *handler) withAdmin(next http.Handler) http.Handler {
+	if h.admin == nil {
+		return next
+	}
+	prefix := strings.TrimSuffix(h.admin.Path, "/") + "/"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get(hAuthorization), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(h.admin.Token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		resource, subject, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		switch {
+		case resource == "quotas" && h.quotaStore != nil:
+			h.serveAdminQuotas(w, r, subject)
+		case resource == "origin-rejections" && subject == "":
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			writeJSON(w, http.StatusOK, h.originRejections())
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
+
+func (h *handler) serveAdminQuotas(w http.ResponseWriter, r *http.Request, subject string) {
+	switch {
+	case r.Method == http.MethodGet:
+		usage := h.quotaStore.snapshot(subject)
+		if subject != "" && len(usage) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, usage)
+	case r.Method == http.MethodDelete && subject != "":
+		if !h.quotaStore.reset(subject) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(value)
+}
@@ -7,9 +7,36 @@ import (
 	"crypto/md5"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"io"
+	"strings"
 )
 
+var (
+	errInvalidPayloadLength = errors.New("invalid payload length")
+	errInvalidPadding       = errors.New("invalid padding")
+)
+
+// Encrypt is for encrypting a payload exactly the same way the proxy encrypts its responses
+func Encrypt(authorization, sharedKey string, plaintext []byte) ([]byte, error) {
+	return aesEncrypt(aesKey(strings.TrimSpace(authorization)+strings.TrimSpace(sharedKey)), plaintext)
+}
+
+// Decrypt is the inverse of Encrypt and EncryptCompressed and mirrors what the `proxy` function of the asma VM does.
+// Compressed plaintexts can't get larger than DefaultMaxDecompressedSize
+func Decrypt(authorization, sharedKey string, payload []byte) ([]byte, error) {
+	return DecryptWithLimit(authorization, sharedKey, payload, DefaultMaxDecompressedSize)
+}
+
+// DecryptWithLimit is the same as Decrypt, failing when a compressed plaintext gets larger than maxSize bytes
+func DecryptWithLimit(authorization, sharedKey string, payload []byte, maxSize int64) ([]byte, error) {
+	plaintext, err := aesDecrypt(aesKey(strings.TrimSpace(authorization)+strings.TrimSpace(sharedKey)), payload)
+	if err != nil {
+		return nil, err
+	}
+	return openEnvelope(plaintext, maxSize)
+}
+
 // This will usually receive a JWT token as an input, but since the token has more than 32 bytes, we'll hash it so it
 // can be used as a key for AES encryption
 func aesKey(input string) []byte {
@@ -41,6 +68,24 @@ func aesEncrypt(key []byte, input []byte) ([]byte, error) {
 	return output, nil
 }
 
+func aesDecrypt(key []byte, input []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	// The IV is prepended to the cipher text, which is made out of at least one block
+	if len(input) < 2*aes.BlockSize || len(input)%aes.BlockSize != 0 {
+		return nil, errInvalidPayloadLength
+	}
+
+	iv, payload := input[:aes.BlockSize], input[aes.BlockSize:]
+	output := make([]byte, len(payload))
+	mode := cipher.NewCBCDecrypter(block, iv)
+	mode.CryptBlocks(output, payload)
+
+	return pkcs7Unpadding(output, aes.BlockSize)
+}
+
 func withPadding(payload []byte, blockSize int) []byte {
 	if len(payload)%aes.BlockSize == 0 {
 		return payload
@@ -59,6 +104,23 @@ func pkcs7Padding(payload []byte, blockSize int) ([]byte, uint8) {
 	return append(payload, text...), uint8(padding)
 }
 
+// Removes the padding added by pkcs7Padding, making sure it's well-formed
+func pkcs7Unpadding(payload []byte, blockSize int) ([]byte, error) {
+	if len(payload) == 0 || len(payload)%blockSize != 0 {
+		return nil, errInvalidPadding
+	}
+	padding := int(payload[len(payload)-1])
+	if padding == 0 || padding > blockSize {
+		return nil, errInvalidPadding
+	}
+	for _, b := range payload[len(payload)-padding:] {
+		if int(b) != padding {
+			return nil, errInvalidPadding
+		}
+	}
+	return payload[:len(payload)-padding], nil
+}
+
 func zeroPad(payload []byte, blockSize int) []byte {
 	padding := blockSize - len(payload)%blockSize
 	text := bytes.Repeat([]byte{byte('0')}, padding)
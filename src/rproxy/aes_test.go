@@ -0,0 +1,40 @@
+package rproxy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	for _, plaintext := range [][]byte{
+		[]byte(""),
+		[]byte(`{"slideshow":{"author":"Yours Truly"}}`),
+		bytes.Repeat([]byte("a"), 16),
+	} {
+		payload, err := Encrypt("Bearer token", "shared-key", plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := Decrypt(" Bearer token ", "shared-key", payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatalf("expected %q, got %q", plaintext, decrypted)
+		}
+	}
+}
+
+func TestDecryptWithWrongKey(t *testing.T) {
+	payload, err := Encrypt("", "shared-key", []byte("plaintext"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The padding may still happen to be valid, but the plain text is never recovered
+	if decrypted, err := Decrypt("", "another-key", payload); err == nil && bytes.Equal(decrypted, []byte("plaintext")) {
+		t.Fatal("expected decryption to fail with the wrong key")
+	}
+	if _, err := Decrypt("", "shared-key", payload[:16]); err != errInvalidPayloadLength {
+		t.Fatalf("expected %v, got %v", errInvalidPayloadLength, err)
+	}
+}
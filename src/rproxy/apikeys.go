@@ -0,0 +1,98 @@
+package rproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// What the encryption key of the responses to API key holders can be derived from
+const (
+	apiKeyEncryptionKeyAuthorization = "authorization"
+	apiKeyEncryptionKeyOwner         = "owner"
+	apiKeyEncryptionKeyAPIKey        = "apiKey"
+)
+
+var errUnknownAPIKey = errors.New("unknown API key")
+
+// HashAPIKey is for hashing an API key the way it goes in the `apiKeys` section of the config
+func HashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func (k *apiKey) validate() error {
+	if k.Owner == "" {
+		return errors.New("owner is required")
+	}
+	if hash, err := hex.DecodeString(k.KeyHash); err != nil || len(hash) != sha256.Size {
+		return errors.New("keyHash must be the hex encoded SHA-256 of the key")
+	}
+	if !lo.Contains([]string{"", apiKeyEncryptionKeyAuthorization, apiKeyEncryptionKeyOwner, apiKeyEncryptionKeyAPIKey}, k.EncryptionKey) {
+		return fmt.Errorf("unknown encryptionKey %q", k.EncryptionKey)
+	}
+	for _, rt := range k.Routes {
+		if err := rt.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compiledAPIKey is an API key with its routes ready to be matched
+type compiledAPIKey struct {
+	apiKey
+	routes []*routeMatcher
+}
+
+// compileAPIKeys is for indexing the API keys by their hash
+func compileAPIKeys(keys []apiKey) (map[string]*compiledAPIKey, error) {
+	compiled := make(map[string]*compiledAPIKey, len(keys))
+	for _, k := range keys {
+		ck := &compiledAPIKey{apiKey: k}
+		for _, rt := range k.Routes {
+			m, err := newRouteMatcher(rt)
+			if err != nil {
+				return nil, err
+			}
+			ck.routes = append(ck.routes, m)
+		}
+		compiled[strings.ToLower(k.KeyHash)] = ck
+	}
+	return compiled, nil
+}
+
+// authenticateAPIKey is for finding out who the API key that came with the request belongs to
+func (h *handler) authenticateAPIKey(key string) *identity {
+	k, ok := h.apiKeys[HashAPIKey(key)]
+	if !ok {
+		return &identity{err: errUnknownAPIKey}
+	}
+	id := &identity{subject: "apiKey:" + k.Owner, verified: true, user: k.Owner, tier: k.Tier, apiKey: k}
+	switch k.EncryptionKey {
+	case apiKeyEncryptionKeyOwner:
+		id.keyMaterial = k.Owner
+	case apiKeyEncryptionKeyAPIKey:
+		id.keyMaterial = key
+	}
+	return id
+}
+
+// isAPIKeyAllowed is for checking whether the API key the request was made with (if any) may reach the destination
+// with the method of the request
+func (h *handler) isAPIKeyAllowed(r *http.Request, destination *url.URL) bool {
+	k := requestIdentity(r).apiKey
+	if k == nil {
+		return true
+	}
+	if len(k.Methods) > 0 && !lo.Contains(k.Methods, r.Method) {
+		return false
+	}
+	return len(k.routes) == 0 || lo.ContainsBy(k.routes, func(m *routeMatcher) bool { return m.match(destination) })
+}
@@ -0,0 +1,105 @@
+package rproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	apiKeys, err := compileAPIKeys([]apiKey{
+		{
+			Owner:         "partner",
+			KeyHash:       HashAPIKey("partner-key"),
+			Routes:        []route{{Host: "api.fundamentei.io", Path: "/v1/*"}},
+			Methods:       []string{http.MethodGet},
+			Tier:          "partners",
+			EncryptionKey: apiKeyEncryptionKeyOwner,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handler{apiKeys: apiKeys, quotas: &quotas{DefaultTier: "free"}}
+
+	r := httptest.NewRequest(http.MethodGet, "/https://api.fundamentei.io/v1/json", nil)
+	r.Header.Set(hXAPIKey, "partner-key")
+	r.Header.Set(hAuthorization, "token")
+	handled := false
+	h.withIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled = true
+		id := requestIdentity(r)
+		if id.err != nil || id.subject != "apiKey:partner" || id.user != "partner" || h.tierOf(r) != "partners" {
+			t.Fatalf("unexpected identity %+v", id)
+		}
+		if key := encryptionKeyMaterial(r); key != "partner" {
+			t.Fatalf("expected the encryption key to be derived from the owner, got %q", key)
+		}
+
+		tests := []struct {
+			method      string
+			destination string
+			allowed     bool
+		}{
+			{http.MethodGet, "https://api.fundamentei.io/v1/json", true},
+			{http.MethodPost, "https://api.fundamentei.io/v1/json", false},
+			{http.MethodGet, "https://api.fundamentei.io/internal", false},
+			{http.MethodGet, "https://admin.fundamentei.io/v1/json", false},
+		}
+		for _, tt := range tests {
+			destination, _ := url.Parse(tt.destination)
+			r.Method = tt.method
+			if got := h.isAPIKeyAllowed(r, destination); got != tt.allowed {
+				t.Errorf("%s %s: expected allowed to be %v, got %v", tt.method, tt.destination, tt.allowed, got)
+			}
+		}
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	if !handled {
+		t.Fatal("expected the request to be handled")
+	}
+
+	r.Header.Set(hXAPIKey, "guessed-key")
+	if id := h.authenticate(r); id.err != errUnknownAPIKey {
+		t.Fatalf("expected the key to be rejected, got %+v", id)
+	}
+	// Requests without a key are identified by the Authorization header as usual
+	r.Header.Del(hXAPIKey)
+	if id := h.authenticate(r); id.apiKey != nil || id.subject != hashedSubject("authorization", "token") || h.tierOf(r) != "free" {
+		t.Fatalf("unexpected identity %+v", id)
+	}
+}
+
+func TestAPIKeyNotForwarded(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get(hXAPIKey); key != "" {
+			t.Errorf("expected the API key not to be forwarded, got %q", key)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewHandler(&Config{
+		General: general{
+			AllowedHosts:         []string{"127.0.0.1:*"},
+			AllowedMethods:       []string{http.MethodGet},
+			IsEncryptedHeaderKey: "X-Is-Encrypted",
+			SharedKey:            "shared",
+		},
+		Limits:  limits{MaxRequestSizeInKB: 1024, MaxResponseSizeInKB: 1024},
+		APIKeys: []apiKey{{Owner: "partner", KeyHash: HashAPIKey("partner-key")}},
+		// Even when the header rules let it through
+		Headers: headers{Request: headerRules{Mode: headerModeAllowlist, Allow: []string{hXAPIKey}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/json", nil)
+	r.Header.Set(hXAPIKey, "partner-key")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the request to be proxied, got %d", w.Code)
+	}
+}
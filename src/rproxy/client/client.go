@@ -0,0 +1,146 @@
+// Package client is for calling APIs through the proxy from Go, decrypting the responses the same way the asma VM does
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"fundamentei.io/rproxy/src/rproxy"
+)
+
+// DefaultIsEncryptedHeaderKey is the header name used by the example config to flag encrypted responses
+const DefaultIsEncryptedHeaderKey = "X-Fndm-Is-Encrypted"
+
+// Transport is an http.RoundTripper that routes requests through the proxy and transparently decrypts its responses.
+// Requests are made as if the destination was being requested directly, e.g. `GET https://httpbin.org/json?page=2`,
+// query string included. Responses compressed before being encrypted are decompressed as well
+type Transport struct {
+	// ProxyURL is where the proxy is reachable at, e.g. `https://rproxy.fundamentei.io`
+	ProxyURL *url.URL
+	// SharedKey must be the same as `general.sharedKey` from the proxy config
+	SharedKey string
+	// Authorization is sent on requests that don't have an `Authorization` header already. The value that ends up being
+	// sent is also used for decrypting the response
+	Authorization string
+	// EncryptionKey is used for decrypting responses in place of the Authorization header that was sent. It's meant for
+	// proxies deriving the encryption key from a claim of the token (`jwt.encryptionKeyClaim`), e.g. the "sub" claim
+	EncryptionKey string
+	// IsEncryptedHeaderKey must be the same as `general.isEncryptedHeaderKey` from the proxy config. Defaults to
+	// DefaultIsEncryptedHeaderKey
+	IsEncryptedHeaderKey string
+	// OriginalContentTypeHeaderKey must be the same as `headers.originalContentTypeHeader` from the proxy config. The
+	// Content-Type of decrypted responses is restored from it. Defaults to rproxy.DefaultOriginalContentTypeHeader
+	OriginalContentTypeHeaderKey string
+	// MaxDecompressedSize is how many bytes a compressed response is allowed to decompress into before failing. Defaults
+	// to rproxy.DefaultMaxDecompressedSize
+	MaxDecompressedSize int64
+	// Base is the underlying transport used to talk to the proxy. Defaults to http.DefaultTransport
+	Base http.RoundTripper
+}
+
+// NewTransport is for creating a transport that sends requests through the proxy at proxyURL
+func NewTransport(proxyURL string, sharedKey string) (*Transport, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL: %q", proxyURL)
+	}
+	return &Transport{ProxyURL: u, SharedKey: sharedKey}, nil
+}
+
+// NewClient is for creating an HTTP client that sends requests through the proxy at proxyURL
+func NewClient(proxyURL string, sharedKey string) (*http.Client, error) {
+	t, err := NewTransport(proxyURL, sharedKey)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.ProxyURL == nil {
+		return nil, errors.New("rproxy/client: missing proxy URL")
+	}
+
+	preq := req.Clone(req.Context())
+	// The destination goes URL-encoded right after the proxy URL, which is one of the formats the proxy understands.
+	// Encoding the query string along with the rest keeps its own encoded characters intact once the proxy decodes it
+	proxyURL, err := url.Parse(strings.TrimSuffix(t.ProxyURL.String(), "/") + "/" + url.QueryEscape(req.URL.String()))
+	if err != nil {
+		return nil, err
+	}
+	preq.URL = proxyURL
+	preq.Host = ""
+	if preq.Header.Get("Authorization") == "" && t.Authorization != "" {
+		preq.Header.Set("Authorization", t.Authorization)
+	}
+
+	res, err := t.base().RoundTrip(preq)
+	if err != nil {
+		return nil, err
+	}
+	if res.Header.Get(t.isEncryptedHeaderKey()) != "true" {
+		return res, nil
+	}
+
+	defer res.Body.Close()
+	payload, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	key := t.EncryptionKey
+	if key == "" {
+		key = preq.Header.Get("Authorization")
+	}
+	body, err := rproxy.DecryptWithLimit(key, t.SharedKey, payload, t.maxDecompressedSize())
+	if err != nil {
+		return nil, fmt.Errorf("rproxy/client: couldn't decrypt the response: %w", err)
+	}
+
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	res.Header.Set(t.isEncryptedHeaderKey(), "false")
+	if contentType := res.Header.Get(t.originalContentTypeHeaderKey()); contentType != "" {
+		res.Header.Set("Content-Type", contentType)
+		res.Header.Del(t.originalContentTypeHeaderKey())
+	}
+	return res, nil
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+func (t *Transport) maxDecompressedSize() int64 {
+	if t.MaxDecompressedSize > 0 {
+		return t.MaxDecompressedSize
+	}
+	return rproxy.DefaultMaxDecompressedSize
+}
+
+func (t *Transport) isEncryptedHeaderKey() string {
+	if t.IsEncryptedHeaderKey != "" {
+		return t.IsEncryptedHeaderKey
+	}
+	return DefaultIsEncryptedHeaderKey
+}
+
+func (t *Transport) originalContentTypeHeaderKey() string {
+	if t.OriginalContentTypeHeaderKey != "" {
+		return t.OriginalContentTypeHeaderKey
+	}
+	return rproxy.DefaultOriginalContentTypeHeader
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"fundamentei.io/rproxy/src/rproxy"
+)
+
+func TestTransport(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"authorization":"`+r.Header.Get("Authorization")+`"}`)
+		case "/query":
+			io.WriteString(w, r.URL.RawQuery)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := &rproxy.Config{}
+	cfg.General.SharedKey = "shared-key"
+	cfg.General.IsEncryptedHeaderKey = DefaultIsEncryptedHeaderKey
+	cfg.General.AllowedHosts = []string{"127.0.0.1:*"}
+	cfg.General.AllowedMethods = []string{http.MethodGet}
+	cfg.Limits.MaxRequestSizeInKB = 10
+	cfg.Limits.MaxResponseSizeInKB = 10
+	handler, err := rproxy.NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+
+	client, err := NewClient(proxy.URL, "shared-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Transport.(*Transport).Authorization = "Bearer token"
+
+	res, err := client.Get(upstream.URL + "/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"authorization":"Bearer token"}`; string(body) != expected {
+		t.Fatalf("expected %q, got %q", expected, body)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("expected the original Content-Type to be restored, got %q", contentType)
+	}
+
+	// Query strings reach the destination untouched, encoded characters included
+	query := "q=a%26b+c&page=2&empty="
+	res, err = client.Get(upstream.URL + "/query?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, err = io.ReadAll(res.Body); err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != query {
+		t.Fatalf("expected the query %q to be forwarded, got %q", query, body)
+	}
+}
@@ -1,6 +1,18 @@
 package rproxy
 
-import "github.com/BurntSushi/toml"
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gobwas/glob"
+	"github.com/samber/lo"
+)
 
 // Config is for representing all the "configurable"s
 type Config struct {
@@ -8,6 +20,35 @@ type Config struct {
 	Limits   limits       `toml:"limits"`
 	Timeouts timeouts     `toml:"timeouts"`
 	CORS     *corsOptions `toml:"cors"`
+	TLS      *tlsOptions  `toml:"tls"`
+	// CORS settings for specific destinations, the first one matching the destination is used instead of [cors]
+	CORSPolicies []corsPolicy `toml:"corsPolicies"`
+	// Which headers identifying the client are sent to the destinations
+	Forwarding forwarding `toml:"forwarding"`
+	// Settings that only apply to some of the destinations, the first one matching the destination host is used
+	Upstreams []upstream `toml:"upstreams"`
+	// Settings overriding the general ones for the destinations matching each of them
+	Policies []policy `toml:"policies"`
+	// Restricts which paths of the allowed hosts can be reached
+	PathRules pathRules `toml:"pathRules"`
+	// Changes the headers sent to the destinations and the ones sent back to the clients
+	Headers headers `toml:"headers"`
+	// Compresses the plaintext of encrypted responses before encrypting it
+	Compression *compression `toml:"compression"`
+	// Restricts which pages may make requests to the destinations matching each of them
+	OriginRules []originRule `toml:"originRules"`
+	// Limits how fast clients can make requests to the destinations matching each of them
+	RateLimits []rateLimit `toml:"rateLimits"`
+	// Verifies the Authorization header is a valid JWT before proxying
+	JWT *jwtOptions `toml:"jwt"`
+	// Keys partners can authenticate with through the X-Api-Key header, instead of the Authorization header
+	APIKeys []apiKey `toml:"apiKeys"`
+	// Limits how much authenticated users can use the proxy per day and month
+	Quotas *quotas `toml:"quotas"`
+	// Endpoints for operating the proxy, they're disabled unless this is defined
+	Admin *admin `toml:"admin"`
+	// Restricts which clients may reach which destinations based on their verified TLS client certificate
+	ClientCertRules []clientCertRule `toml:"clientCertRules"`
 }
 
 type general struct {
@@ -23,10 +64,27 @@ type general struct {
 	AllowedHosts          []string `toml:"allowedHosts"`
 	DisallowedHosts       []string `toml:"disallowedHosts"`
 	AllowedMethods        []string `toml:"allowedMethods"`
-	// If enabled it won't pass through CORS requests. Not implemented yet
+	// CIDRs (or single IPs) of the proxies in front of this one, such as load balancers and CDNs. The forwarding headers
+	// are only taken into account when the request comes from one of them, otherwise they could be spoofed
+	// On AWS Lambda behind an ALB there's no peer to check, so they're only taken into account when this is set
+	TrustedProxies []string `toml:"trustedProxies"`
+	// Header the trusted proxies write the client IP to. Either "X-Forwarded-For" (default), "Forwarded" or
+	// "X-Real-Ip". Only this one is read, since proxies usually pass the other ones through as the client sent them
+	ClientIPHeader string `toml:"clientIPHeader"`
+	// If enabled any origin is allowed, credentials included, reflecting the origin of the request back. It's useful
+	// for development but not recommended in production. It takes precedence over the [cors] section
 	UnsafeCORS bool `toml:"unsafeCORS"`
 	// Is the address that the proxy will listen to when running locally
 	Listen string `toml:"listen"`
+	// The format of the events the proxy is invoked with on AWS Lambda. Either "auto" (default), "apigateway-v1",
+	// "apigateway-v2", "function-url" or "alb"
+	LambdaEventFormat string `toml:"lambdaEventFormat"`
+	// Path answering whether the standalone server is ready to take traffic. It starts failing as soon as the server
+	// begins shutting down so load balancers can stop sending requests during the drain period. Empty disables it
+	ReadinessPath string `toml:"readinessPath"`
+	// If enabled the config file is polled for changes and reloaded automatically. Sending a SIGHUP to the process
+	// reloads it regardless of this setting. Only applies to the standalone server
+	WatchConfig bool `toml:"watchConfig"`
 }
 
 // https://github.com/rs/cors/blob/master/cors.go#L32
@@ -37,7 +95,262 @@ type corsOptions struct {
 	ExposedHeaders   []string `toml:"exposedHeaders"`
 	MaxAge           int      `toml:"maxAge"`
 	AllowCredentials bool     `toml:"allowCredentials"`
-	// AllowPrivateNetwork bool `toml:"allowPrivateNetwork"`
+	// Answers preflight requests asking for Private Network Access, which browsers send before letting public pages
+	// reach the proxy on a private network
+	AllowPrivateNetwork bool `toml:"allowPrivateNetwork"`
+}
+
+type corsPolicy struct {
+	route
+	corsOptions
+}
+
+// Is for terminating TLS on the standalone server. It's left out when running on AWS Lambda
+type tlsOptions struct {
+	// When there's more than one certificate, the one served is picked based on the server name (SNI) the client asks
+	// for, falling back to the first one
+	Certificates []tlsCertificate `toml:"certificates"`
+	// Either "1.0", "1.1", "1.2" or "1.3". Defaults to "1.2"
+	MinVersion string `toml:"minVersion"`
+	// Restricts the cipher suites negotiated on TLS 1.2 and below, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". TLS 1.3
+	// cipher suites aren't configurable
+	CipherSuites []string `toml:"cipherSuites"`
+	// Reloads the certificates whenever their files change, so renewed certificates are picked up without a restart
+	WatchCertificates bool `toml:"watchCertificates"`
+	// Address of a plain HTTP listener that redirects every request to HTTPS. Empty disables it
+	RedirectListen string `toml:"redirectListen"`
+	// Either "none", "optional" (verified only when presented) or "require". Defaults to "none"
+	ClientAuth string `toml:"clientAuth"`
+	// PEM bundle with the CAs client certificates are verified against. Required unless clientAuth is "none"
+	ClientCAFile string `toml:"clientCaFile"`
+}
+
+type tlsCertificate struct {
+	CertFile string `toml:"certFile"`
+	KeyFile  string `toml:"keyFile"`
+}
+
+// Values coming from clients that aren't trusted proxies are always stripped from the managed headers, since they could
+// be spoofed
+type forwarding struct {
+	// Either "append" (adds the client IP to the list of the previous proxies), "replace" (sends the client IP only) or
+	// "none" (default). When all the headers are disabled, the ones sent by trusted proxies are passed through as they
+	// came
+	XForwardedFor string `toml:"xForwardedFor"`
+	// Sends the host and the scheme the client requested the proxy with
+	XForwardedHost  bool `toml:"xForwardedHost"`
+	XForwardedProto bool `toml:"xForwardedProto"`
+	// Sends the standard `Forwarded` header (RFC 7239), appending to the one from the previous proxies
+	Forwarded bool `toml:"forwarded"`
+}
+
+// Scripts can send whatever Origin they want, so this is another layer against scraping rather than an authentication
+// method
+type originRule struct {
+	route
+	// Identifies the rule in the logs and in the rejection counters
+	Name string `toml:"name"`
+	// Globs matched against the origin of the page that made the request (e.g. "https://*.fundamentei.io"), taken from
+	// the Origin header or, when it's missing, from the Referer header. Empty allows any origin
+	AllowedOrigins []string `toml:"allowedOrigins"`
+	// Values of the Sec-Fetch-Site header that are accepted, out of "same-origin", "same-site", "cross-site" and "none".
+	// Requests without the header, made by older browsers and most scripts, aren't checked against it. Empty allows any
+	AllowedFetchSites []string `toml:"allowedFetchSites"`
+	// Lets requests with neither Origin nor Referer through, such as the ones made by servers
+	AllowMissingOrigin bool `toml:"allowMissingOrigin"`
+}
+
+type rateLimit struct {
+	route
+	// Identifies the limit in the logs and its buckets, so it's required and must be unique
+	Name string `toml:"name"`
+	// Only applies to the users in these tiers. Empty applies to everyone
+	Tiers []string `toml:"tiers"`
+	// What requests are limited by. Either "ip" (default), "authorization" (the subject of the verified token) or "apiKey"
+	// (the owner of the X-Api-Key header). Requests without verified credentials are limited by IP
+	Key string `toml:"key"`
+	// How many tokens are added back to the bucket every second, each request takes one
+	RequestsPerSecond float64 `toml:"requestsPerSecond"`
+	// How many requests can be made at once, which is the size of the bucket
+	Burst int `toml:"burst"`
+}
+
+// Quotas are tracked per user, identified by the subject of their verified token or the owner of their API key.
+// Requests without verified credentials are tracked by the client IP on the default tier
+type quotas struct {
+	// JSON file the usage is persisted to. Keep in mind that on AWS Lambda the file system is ephemeral
+	StoreFile string `toml:"storeFile"`
+	// Tier applied to the users that don't have one assigned
+	DefaultTier string      `toml:"defaultTier"`
+	Tiers       []quotaTier `toml:"tiers"`
+}
+
+// Limits set to zero are unlimited. Bytes are counted on the responses sent back to the clients
+type quotaTier struct {
+	Name             string `toml:"name"`
+	RequestsPerDay   int64  `toml:"requestsPerDay"`
+	RequestsPerMonth int64  `toml:"requestsPerMonth"`
+	BytesPerDay      int64  `toml:"bytesPerDay"`
+	BytesPerMonth    int64  `toml:"bytesPerMonth"`
+}
+
+// Tokens can be sent as is or prefixed by "Bearer "
+type jwtOptions struct {
+	// Which of "HS256", "RS256" and "ES256" are accepted. Tokens signed with any other algorithm are rejected
+	Algorithms []string `toml:"algorithms"`
+	// Secret HS256 tokens are signed with
+	HMACSecret string `toml:"hmacSecret"`
+	// PEM files with the public keys (or certificates) RS256 and ES256 tokens are verified with
+	PublicKeyFiles []string `toml:"publicKeyFiles"`
+	// JSON Web Key Set file with public keys, picked based on the "kid" header of the token
+	JWKSFile string `toml:"jwksFile"`
+	// When defined, the "iss" claim must be equal to it
+	Issuer string `toml:"issuer"`
+	// When defined, the "aud" claim must contain at least one of them
+	Audience []string `toml:"audience"`
+	// How many seconds of clock skew are tolerated when checking the "exp" and "nbf" claims
+	Leeway uint32 `toml:"leeway"`
+	// Lets requests without an Authorization header through. Tokens that come with requests are verified regardless
+	AllowAnonymous bool `toml:"allowAnonymous"`
+	// Derives the encryption key from this claim (e.g. "sub") instead of the raw token, so it doesn't change when the
+	// token is renewed. Clients must then decrypt responses with the claim value in place of the Authorization header
+	EncryptionKeyClaim string `toml:"encryptionKeyClaim"`
+	// Claim holding the name of the quota tier of the user
+	TierClaim string `toml:"tierClaim"`
+}
+
+type apiKey struct {
+	// Who the key belongs to. It identifies the requests made with the key in quotas, rate limits and logs
+	Owner string `toml:"owner"`
+	// Hex encoded SHA-256 of the key, as printed by `rproxy keygen --api-key`
+	KeyHash string `toml:"keyHash"`
+	// Destinations the key can reach, on top of the ones allowed by the general section. Empty allows all of them
+	Routes []route `toml:"routes"`
+	// Methods the key can be used with, on top of the ones allowed by the general section. Empty allows all of them
+	Methods []string `toml:"methods"`
+	// Tier of the owner, which decides the quotas and rate limits applied to them
+	Tier string `toml:"tier"`
+	// What the encryption key of the responses is derived from. Either "authorization" (the Authorization header, the
+	// default), "owner" or "apiKey" (the key itself)
+	EncryptionKey string `toml:"encryptionKey"`
+}
+
+type admin struct {
+	// Path prefix the admin endpoints are served under, e.g. "/_rproxy/admin"
+	Path string `toml:"path"`
+	// Bearer token required to call the admin endpoints
+	Token string `toml:"token"`
+}
+
+// When more than one policy matches a destination, the most specific one wins, which is the one with the most literal
+// characters in its host glob and then in its path glob. Settings that are left out are taken from the general ones
+type policy struct {
+	route
+	// Identifies the policy in the logs
+	Name string `toml:"name"`
+	// Replaces general.allowedMethods
+	AllowedMethods []string `toml:"allowedMethods"`
+	// Replace limits.maxRequestSizeInKb and limits.maxResponseSizeInKb
+	MaxRequestSizeInKB  *uint64 `toml:"maxRequestSizeInKb"`
+	MaxResponseSizeInKB *uint64 `toml:"maxResponseSizeInKb"`
+	// Replaces timeouts.clientTimeout
+	Timeout *uint32 `toml:"timeout"`
+	// Turns the encryption of the responses off (or back on), e.g. for public assets
+	Encrypt *bool `toml:"encrypt"`
+	// Changes the headers sent to the destination and the ones sent back to the client, after the rules of the
+	// [headers] section are applied
+	RequestHeaders  headerRules `toml:"requestHeaders"`
+	ResponseHeaders headerRules `toml:"responseHeaders"`
+}
+
+// compression is for compressing the plaintext of encrypted responses, since the ciphertext doesn't compress. The
+// plaintext is wrapped in an envelope flagging how it was compressed, which clients must support
+type compression struct {
+	// Either "gzip" or "br"
+	Algorithm string `toml:"algorithm"`
+	// Plaintexts smaller than this aren't compressed. Defaults to 1024
+	MinSizeInBytes int `toml:"minSizeInBytes"`
+}
+
+type headers struct {
+	// Headers of the destination responses passed through to the clients, which can be globs, e.g. "X-Fndm-*". Responses
+	// to OPTIONS requests pass every header through. Defaults to Cache-Control, Content-Language, Content-Type, Expires,
+	// Last-Modified and Link. Passing Set-Cookie through is risky, since every destination shares the origin of the
+	// proxy and the cookies set by one of them are sent to all the others
+	PassThrough []string `toml:"passThrough"`
+	// Header the original Content-Type of encrypted responses is sent on, since their Content-Type describes the
+	// encrypted payload. Defaults to "X-Original-Content-Type"
+	OriginalContentTypeHeader string `toml:"originalContentTypeHeader"`
+	// Applies to the headers sent by the clients, which are copied over to the requests to the destinations
+	Request headerRules `toml:"request"`
+	// Applies to the headers sent by the destinations, which are copied over to the responses to the clients
+	Response headerRules `toml:"response"`
+}
+
+// Header names are case-insensitive. The headers are filtered while they're copied over, and then removed, set and
+// appended in that order. The values of set and appended headers can have placeholders: {realIP}, {requestID},
+// {route} (the name of the policy), {user} (who the user is according to verified credentials) and {host} (the
+// destination host)
+type headerRules struct {
+	// Either "denylist" (the default, every header is copied but the denied ones) or "allowlist" (only the allowed
+	// headers are copied)
+	Mode  string   `toml:"mode"`
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
+	// Headers removed after being copied
+	Remove []string `toml:"remove"`
+	// Headers set to the given values, replacing whatever was there
+	Set map[string]string `toml:"set"`
+	// Headers added with the given values, keeping whatever was there
+	Append map[string]string `toml:"append"`
+}
+
+// Paths are decoded and cleaned of dot segments and repeated slashes before being matched, and requests are proxied
+// with the very path that was matched
+type pathRules struct {
+	// Requests matching any of these rules are denied
+	Deny []pathRule `toml:"deny"`
+	// When any of these rules covers the destination host, requests must match at least one of them
+	Allow []pathRule `toml:"allow"`
+}
+
+type pathRule struct {
+	// Glob matched against the destination host. Empty matches every host
+	Host string `toml:"host"`
+	// Globs matched against the destination path, where `*` also matches slashes, e.g. "/admin/*"
+	Paths []string `toml:"paths"`
+	// Regular expressions matched against the destination path, e.g. "^/v[0-9]+/internal(/|$)"
+	PathRegexes []string `toml:"pathRegexes"`
+	// Only applies the rule to these methods. Empty applies it to every method
+	Methods []string `toml:"methods"`
+}
+
+type clientCertRule struct {
+	// Globs matched against the destination host. Destinations that aren't matched by any rule can be reached by anyone
+	Hosts []string `toml:"hosts"`
+	// Globs matched against the common name of the client certificate. Requests to the hosts above coming without a
+	// verified certificate with a matching common name are denied
+	CommonNames []string `toml:"commonNames"`
+}
+
+type upstream struct {
+	// Glob matched against the destination host, the same way `general.allowedHosts` are
+	Host string      `toml:"host"`
+	TLS  upstreamTLS `toml:"tls"`
+}
+
+// Is for talking to destinations that use a private CA or require mutual TLS
+type upstreamTLS struct {
+	// PEM bundle with the CAs trusted when verifying the destination certificate, instead of the system roots
+	CAFile string `toml:"caFile"`
+	// Client certificate presented to destinations requiring mutual TLS
+	CertFile string `toml:"certFile"`
+	KeyFile  string `toml:"keyFile"`
+	// Overrides the server name used for SNI and for verifying the destination certificate
+	ServerName string `toml:"serverName"`
+	// Base64 encoded SHA-256 hashes of the subject public key info of certificates. When defined, at least one of the
+	// certificates in the chain presented by the destination must match one of them
+	PinnedSPKIHashes []string `toml:"pinnedSpkiHashes"`
 }
 
 type limits struct {
@@ -52,6 +365,8 @@ type limits struct {
 // https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
 // https://i.stack.imgur.com/OWegJ.png
 type timeouts struct {
+	// ClientTimeout limits the time spent on a whole request to a destination, from connecting to reading the body of
+	// the response. Zero means no limit
 	ClientTimeout uint32 `toml:"clientTimeout"`
 	// DialerTimeoutMS limits the time spent establishing a TCP connection (if a new one is needed)
 	DialerTimeout uint32 `toml:"dialerTimeout"`
@@ -64,6 +379,28 @@ type timeouts struct {
 	ExpectContinueTimeout uint32 `toml:"expectContinueTimeout"`
 	// IdleConnTimeoutMS limits the amount of time an idle connection is kept in the connection pool
 	IdleConnTimeout uint32 `toml:"idleConnTimeout"`
+
+	// The following only apply to the standalone server, which is what the proxy clients connect to
+
+	// ReadHeaderTimeout limits the time spent reading the headers of an incoming request
+	ReadHeaderTimeout uint32 `toml:"readHeaderTimeout"`
+	// ReadTimeout limits the time spent reading an entire incoming request, including the body
+	ReadTimeout uint32 `toml:"readTimeout"`
+	// WriteTimeout limits the time spent from the end of the request headers read to the end of the response write
+	WriteTimeout uint32 `toml:"writeTimeout"`
+	// IdleTimeout limits the amount of time a keep-alive connection from a client is kept open waiting for a request
+	IdleTimeout uint32 `toml:"idleTimeout"`
+	// ShutdownDrainPeriod is how long the server keeps serving requests after being asked to shut down, while its
+	// readiness check fails, so load balancers have time to take it out of rotation
+	ShutdownDrainPeriod uint32 `toml:"shutdownDrainPeriod"`
+	// ShutdownTimeout limits the time spent waiting for in-flight requests to finish after the drain period. Zero
+	// means waiting for as long as it takes
+	ShutdownTimeout uint32 `toml:"shutdownTimeout"`
+}
+
+// seconds is for converting the timeouts from the config into durations
+func seconds(value uint32) time.Duration {
+	return time.Duration(value) * time.Second
 }
 
 // NewConfigFromFile is for parsing the configuration from the specified file
@@ -74,3 +411,137 @@ func NewConfigFromFile(filepath string) (*Config, error) {
 	}
 	return cfg, nil
 }
+
+// ValidateLambda is for making sure the configuration is usable on AWS Lambda, on top of what Validate checks. TLS is
+// terminated before the proxy gets invoked there, so there are no client certificates to check
+func (cfg *Config) ValidateLambda() error {
+	if len(cfg.ClientCertRules) > 0 {
+		return errors.New("clientCertRules aren't supported on AWS Lambda, since TLS is terminated before the proxy")
+	}
+	return nil
+}
+
+// Validate is for making sure the configuration is usable before building a handler out of it
+func (cfg *Config) Validate() error {
+	if strings.TrimSpace(cfg.General.IsEncryptedHeaderKey) == "" {
+		return errors.New("general.isEncryptedHeaderKey can't be empty")
+	}
+	if cfg.General.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.General.Listen); err != nil {
+			return fmt.Errorf("general.listen: %w", err)
+		}
+	}
+	if _, err := parseTrustedProxies(cfg.General.TrustedProxies); err != nil {
+		return fmt.Errorf("general.trustedProxies: %w", err)
+	}
+	if h := cfg.General.ClientIPHeader; h != "" && !lo.Contains(clientIPHeaders, http.CanonicalHeaderKey(h)) {
+		return fmt.Errorf("unknown general.clientIPHeader %q", h)
+	}
+	if !lo.Contains([]string{"", xForwardedForAppend, xForwardedForReplace, xForwardedForNone}, cfg.Forwarding.XForwardedFor) {
+		return fmt.Errorf("unknown forwarding.xForwardedFor %q", cfg.Forwarding.XForwardedFor)
+	}
+	if cfg.General.LambdaEventFormat != "" && !lo.Contains(lambdaEventFormats, cfg.General.LambdaEventFormat) {
+		return fmt.Errorf("unknown general.lambdaEventFormat %q", cfg.General.LambdaEventFormat)
+	}
+	if cfg.General.ReadinessPath != "" && !strings.HasPrefix(cfg.General.ReadinessPath, "/") {
+		return fmt.Errorf("general.readinessPath must start with a slash: %q", cfg.General.ReadinessPath)
+	}
+	if cfg.TLS != nil {
+		if err := cfg.TLS.validate(); err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+	}
+	if cfg.Compression != nil {
+		if err := cfg.Compression.validate(); err != nil {
+			return fmt.Errorf("compression: %w", err)
+		}
+	}
+	for i, p := range cfg.Policies {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("policies[%d]: %w", i, err)
+		}
+	}
+	if _, err := compileHeaderPatterns(cfg.Headers.PassThrough); err != nil {
+		return fmt.Errorf("headers.passThrough: %w", err)
+	}
+	if err := cfg.Headers.Request.validate(); err != nil {
+		return fmt.Errorf("headers.request: %w", err)
+	}
+	if err := cfg.Headers.Response.validate(); err != nil {
+		return fmt.Errorf("headers.response: %w", err)
+	}
+	for i, rule := range cfg.PathRules.Deny {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("pathRules.deny[%d]: %w", i, err)
+		}
+	}
+	for i, rule := range cfg.PathRules.Allow {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("pathRules.allow[%d]: %w", i, err)
+		}
+	}
+	for i, policy := range cfg.CORSPolicies {
+		if err := policy.route.validate(); err != nil {
+			return fmt.Errorf("corsPolicies[%d]: %w", i, err)
+		}
+	}
+	for i, rule := range cfg.OriginRules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("originRules[%d]: %w", i, err)
+		}
+	}
+	for i, rl := range cfg.RateLimits {
+		if err := rl.validate(); err != nil {
+			return fmt.Errorf("rateLimits[%d]: %w", i, err)
+		}
+	}
+	rateLimitNames := lo.Map(cfg.RateLimits, func(rl rateLimit, _ int) string { return rl.Name })
+	if len(lo.Uniq(rateLimitNames)) != len(rateLimitNames) {
+		return errors.New("rateLimits: names must be unique")
+	}
+	if cfg.JWT != nil {
+		if err := cfg.JWT.validate(); err != nil {
+			return fmt.Errorf("jwt: %w", err)
+		}
+	}
+	for i, k := range cfg.APIKeys {
+		if err := k.validate(); err != nil {
+			return fmt.Errorf("apiKeys[%d]: %w", i, err)
+		}
+		if cfg.Quotas != nil && k.Tier != "" && !lo.ContainsBy(cfg.Quotas.Tiers, func(tier quotaTier) bool { return tier.Name == k.Tier }) {
+			return fmt.Errorf("apiKeys[%d]: unknown tier %q", i, k.Tier)
+		}
+	}
+	hashes := lo.Map(cfg.APIKeys, func(k apiKey, _ int) string { return strings.ToLower(k.KeyHash) })
+	if len(lo.Uniq(hashes)) != len(hashes) {
+		return errors.New("apiKeys: keys must be unique")
+	}
+	if cfg.Quotas != nil {
+		if err := cfg.Quotas.validate(); err != nil {
+			return fmt.Errorf("quotas: %w", err)
+		}
+	}
+	if cfg.Admin != nil && (!strings.HasPrefix(cfg.Admin.Path, "/") || len(cfg.Admin.Token) < 16) {
+		return errors.New("admin requires a path starting with a slash and a token of at least 16 characters")
+	}
+	for i, u := range cfg.Upstreams {
+		if err := u.validate(); err != nil {
+			return fmt.Errorf("upstreams[%d]: %w", i, err)
+		}
+	}
+	// Without verifying client certificates there's no common name to match, so every host covered by the rules would be
+	// denied
+	if len(cfg.ClientCertRules) > 0 && (cfg.TLS == nil || clientAuthTypes[cfg.TLS.ClientAuth] == tls.NoClientCert) {
+		return errors.New(`clientCertRules require tls.clientAuth to be either "optional" or "require"`)
+	}
+	patterns := [][]string{cfg.General.AllowedHosts, cfg.General.DisallowedHosts}
+	for _, rule := range cfg.ClientCertRules {
+		patterns = append(patterns, rule.Hosts, rule.CommonNames)
+	}
+	for _, pattern := range lo.Flatten(patterns) {
+		if _, err := glob.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package rproxy
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/rs/cors"
+	"github.com/samber/lo"
+)
+
+// compiledCORSPolicy is a CORS policy ready to be applied to the requests to the destinations matching it
+type compiledCORSPolicy struct {
+	matcher             *routeMatcher
+	cors                *cors.Cors
+	allowPrivateNetwork bool
+}
+
+// newCORS is for building the CORS policies of the proxy. Preflight requests are always answered by the proxy itself,
+// so they never reach the destinations, and the headers flagging encrypted responses and carrying their original
+// Content-Type are always exposed:
+//
+//   - unsafeCORS reflects whatever origin the request comes from and allows credentials, every allowed method, every
+//     header and private network access. It's meant for development and takes precedence over everything else
+//   - [[corsPolicies]] apply to the destinations matching them, the first one matching wins
+//   - [cors] applies to the destinations that aren't matched by any of the policies
+//   - Otherwise cross-origin requests aren't allowed at all
+func newCORS(cfg *Config) (middlewareFunc, error) {
+	if cfg.General.UnsafeCORS {
+		if cfg.CORS != nil || len(cfg.CORSPolicies) > 0 {
+			log.Print("The CORS settings are ignored since unsafeCORS is enabled, which is not recommended in production")
+		}
+		unsafe := &compiledCORSPolicy{
+			cors: cors.New(cors.Options{
+				AllowOriginFunc:  func(origin string) bool { return true },
+				AllowedMethods:   cfg.General.AllowedMethods,
+				AllowedHeaders:   []string{"*"},
+				ExposedHeaders:   exposedHeaders(cfg),
+				AllowCredentials: true,
+			}),
+			allowPrivateNetwork: true,
+		}
+		return withCORSPolicies(nil, unsafe), nil
+	}
+
+	policies := make([]*compiledCORSPolicy, 0, len(cfg.CORSPolicies))
+	for _, policy := range cfg.CORSPolicies {
+		matcher, err := newRouteMatcher(policy.route)
+		if err != nil {
+			return nil, err
+		}
+		cp := newCORSPolicy(&policy.corsOptions, exposedHeaders(cfg))
+		cp.matcher = matcher
+		policies = append(policies, cp)
+	}
+	fallback := &compiledCORSPolicy{cors: cors.New(cors.Options{AllowOriginFunc: func(origin string) bool { return false }})}
+	if cfg.CORS != nil {
+		fallback = newCORSPolicy(cfg.CORS, exposedHeaders(cfg))
+	}
+	return withCORSPolicies(policies, fallback), nil
+}
+
+// exposedHeaders returns the headers clients need to read for decrypting the responses
+func exposedHeaders(cfg *Config) []string {
+	return []string{cfg.General.IsEncryptedHeaderKey, cfg.Headers.originalContentTypeHeader()}
+}
+
+func newCORSPolicy(opts *corsOptions, exposed []string) *compiledCORSPolicy {
+	return &compiledCORSPolicy{
+		cors: cors.New(cors.Options{
+			AllowCredentials: opts.AllowCredentials,
+			AllowedHeaders:   opts.AllowedHeaders,
+			AllowedMethods:   opts.AllowedMethods,
+			AllowedOrigins:   opts.AllowedOrigins,
+			ExposedHeaders:   lo.Uniq(append(exposed, opts.ExposedHeaders...)),
+			MaxAge:           opts.MaxAge,
+		}),
+		allowPrivateNetwork: opts.AllowPrivateNetwork,
+	}
+}
+
+// withCORSPolicies is for applying the policy matching the destination of the request, falling back to the given one
+func withCORSPolicies(policies []*compiledCORSPolicy, fallback *compiledCORSPolicy) middlewareFunc {
+	return func(next http.Handler) http.Handler {
+		handlers := make(map[*compiledCORSPolicy]http.Handler, len(policies)+1)
+		for _, policy := range append(policies, fallback) {
+			handlers[policy] = policy.cors.Handler(next)
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			policy := fallback
+			if destination, err := requestURIToProxyURL(r.RequestURI); destination != nil && err == nil {
+				if matching, ok := lo.Find(policies, func(p *compiledCORSPolicy) bool { return p.matcher.match(destination) }); ok {
+					policy = matching
+				}
+			}
+			if policy.allowPrivateNetwork && r.Method == http.MethodOptions &&
+				r.Header.Get(hAccessControlRequestPrivateNetwork) == "true" {
+				w = &privateNetworkResponseWriter{ResponseWriter: w}
+			}
+			handlers[policy].ServeHTTP(w, r)
+		})
+	}
+}
+
+// privateNetworkResponseWriter is for allowing private network access on the preflight responses that allowed the
+// origin of the request
+type privateNetworkResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *privateNetworkResponseWriter) WriteHeader(statusCode int) {
+	if w.Header().Get(hAccessControlAllowOrigin) != "" {
+		w.Header().Set(hAccessControlAllowPrivateNetwork, "true")
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
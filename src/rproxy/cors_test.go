@@ -0,0 +1,122 @@
+package rproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	general := general{AllowedMethods: []string{http.MethodGet, http.MethodPost}, IsEncryptedHeaderKey: "X-Is-Encrypted"}
+	allowlist := &corsOptions{AllowedOrigins: []string{"https://fundamentei.io"}, AllowedMethods: []string{http.MethodGet}, AllowedHeaders: []string{"Authorization"}}
+	unsafe := general
+	unsafe.UnsafeCORS = true
+
+	tests := []struct {
+		name             string
+		cfg              *Config
+		origin           string
+		allowOrigin      string
+		allowCredentials string
+	}{
+		{"unsafe reflects the origin", &Config{General: unsafe}, "https://evil.com", "https://evil.com", "true"},
+		{"unsafe takes precedence", &Config{General: unsafe, CORS: allowlist}, "https://evil.com", "https://evil.com", "true"},
+		{"allowed origin", &Config{General: general, CORS: allowlist}, "https://fundamentei.io", "https://fundamentei.io", ""},
+		{"disallowed origin", &Config{General: general, CORS: allowlist}, "https://evil.com", "", ""},
+		{"no cors", &Config{General: general}, "https://fundamentei.io", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxied := false
+			withCORS, err := newCORS(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				proxied = true
+			}))
+
+			preflight := httptest.NewRequest(http.MethodOptions, "/https://httpbin.org/json", nil)
+			preflight.Header.Set("Origin", tt.origin)
+			preflight.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			preflight.Header.Set("Access-Control-Request-Headers", "Authorization")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, preflight)
+			if proxied || w.Code != http.StatusNoContent {
+				t.Fatalf("expected the preflight to be answered locally, got %d", w.Code)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Fatalf("expected Access-Control-Allow-Origin %q, got %q", tt.allowOrigin, got)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != tt.allowCredentials {
+				t.Fatalf("expected Access-Control-Allow-Credentials %q, got %q", tt.allowCredentials, got)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/https://httpbin.org/json", nil)
+			r.Header.Set("Origin", tt.origin)
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if !proxied {
+				t.Fatal("expected the request to be proxied")
+			}
+			if tt.allowOrigin != "" && w.Header().Get("Access-Control-Expose-Headers") != "X-Is-Encrypted, X-Original-Content-Type" {
+				t.Fatalf("expected the encryption headers to be exposed, got %q", w.Header().Get("Access-Control-Expose-Headers"))
+			}
+		})
+	}
+}
+
+func TestCORSPolicies(t *testing.T) {
+	withCORS, err := newCORS(&Config{
+		General: general{IsEncryptedHeaderKey: "X-Is-Encrypted"},
+		CORS:    &corsOptions{AllowedOrigins: []string{"https://app.fundamentei.io"}, AllowCredentials: true},
+		CORSPolicies: []corsPolicy{
+			{
+				route:       route{Host: "widgets.fundamentei.io"},
+				corsOptions: corsOptions{AllowedOrigins: []string{"*"}},
+			},
+			{
+				route:       route{Host: "intranet.fundamentei.io"},
+				corsOptions: corsOptions{AllowedOrigins: []string{"https://app.fundamentei.io"}, AllowPrivateNetwork: true},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name                string
+		destination         string
+		origin              string
+		allowOrigin         string
+		allowCredentials    string
+		allowPrivateNetwork string
+	}{
+		{"policy of the destination", "https://widgets.fundamentei.io/embed", "https://blog.com", "*", "", ""},
+		{"fallback to cors", "https://api.fundamentei.io/json", "https://app.fundamentei.io", "https://app.fundamentei.io", "true", ""},
+		{"fallback to cors disallowed", "https://api.fundamentei.io/json", "https://blog.com", "", "", ""},
+		{"private network access", "https://intranet.fundamentei.io/json", "https://app.fundamentei.io", "https://app.fundamentei.io", "", "true"},
+		{"private network access disallowed origin", "https://intranet.fundamentei.io/json", "https://blog.com", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodOptions, "/"+tt.destination, nil)
+			r.Header.Set("Origin", tt.origin)
+			r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			r.Header.Set(hAccessControlRequestPrivateNetwork, "true")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if got := w.Header().Get(hAccessControlAllowOrigin); got != tt.allowOrigin {
+				t.Fatalf("expected Access-Control-Allow-Origin %q, got %q", tt.allowOrigin, got)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != tt.allowCredentials {
+				t.Fatalf("expected Access-Control-Allow-Credentials %q, got %q", tt.allowCredentials, got)
+			}
+			if got := w.Header().Get(hAccessControlAllowPrivateNetwork); got != tt.allowPrivateNetwork {
+				t.Fatalf("expected Access-Control-Allow-Private-Network %q, got %q", tt.allowPrivateNetwork, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package rproxy
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	errUnsupportedContentEncoding = errors.New("unsupported content encoding")
+	errDecodedBodyTooLarge        = errors.New("decoded body is larger than allowed")
+)
+
+// contentEncodings returns the codings applied to a body, in the order they were applied. Multiple codings can either
+// be listed in a single header or spread across several ones
+func contentEncodings(values []string) []string {
+	var encodings []string
+	for _, value := range values {
+		for _, encoding := range strings.Split(value, ",") {
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			if encoding != "" && encoding != "identity" {
+				encodings = append(encodings, encoding)
+			}
+		}
+	}
+	return encodings
+}
+
+// hasNoBody tells whether a response can't carry a body, even though it may still come with a Content-Encoding
+func hasNoBody(method string, statusCode int) bool {
+	return method == http.MethodHead || statusCode == http.StatusNoContent || statusCode == http.StatusNotModified
+}
+
+// decodeBody is for undoing every coding applied to the body, in the reverse order they were applied, so what gets
+// encrypted is always the plain content. Decoding stops as soon as the decoded body gets larger than maxSize, so small
+// payloads that decompress into huge ones can't exhaust the memory of the proxy. Empty bodies are taken as they are,
+// since decoders fail on them even though servers send them with a Content-Encoding anyway
+func decodeBody(body io.Reader, encodings []string, maxSize int64) ([]byte, error) {
+	br := bufio.NewReader(body)
+	if _, err := br.Peek(1); err == io.EOF {
+		return []byte{}, nil
+	}
+	var r io.Reader = br
+	for i := len(encodings) - 1; i >= 0; i-- {
+		decoder, err := newDecoder(r, encodings[i], maxSize)
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		r = decoder
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(encodings) > 0 && int64(len(decoded)) > maxSize {
+		return nil, errDecodedBodyTooLarge
+	}
+	return decoded, nil
+}
+
+func newDecoder(r io.Reader, encoding string, maxSize int64) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return newDeflateReader(r)
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(maxSize)))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnsupportedContentEncoding, encoding)
+	}
+}
+
+// newDeflateReader is for reading "deflate" bodies, which are meant to be zlib streams but are sent as raw deflate by
+// some servers. See: https://www.rfc-editor.org/rfc/rfc9110#section-8.4.1.2
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
@@ -0,0 +1,150 @@
+package rproxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func encode(t *testing.T, data []byte, encoding string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		w, _ = zstd.NewWriter(&buf)
+	default:
+		t.Fatalf("unknown encoding %q", encoding)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestContentEncodings(t *testing.T) {
+	got := contentEncodings([]string{"gzip, identity", " BR ", ""})
+	if expected := []string{"gzip", "br"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	plain := []byte(strings.Repeat(`{"ticker":"FNDM3"}`, 64))
+	tests := []struct {
+		name      string
+		body      []byte
+		encodings []string
+		maxSize   int64
+		err       error
+	}{
+		{name: "identity", body: plain, maxSize: 4096},
+		{name: "gzip", body: encode(t, plain, "gzip"), encodings: []string{"gzip"}, maxSize: 4096},
+		{name: "zlib deflate", body: encode(t, plain, "deflate"), encodings: []string{"deflate"}, maxSize: 4096},
+		{name: "raw deflate", body: encode(t, plain, "raw-deflate"), encodings: []string{"deflate"}, maxSize: 4096},
+		{name: "brotli", body: encode(t, plain, "br"), encodings: []string{"br"}, maxSize: 4096},
+		{name: "zstd", body: encode(t, plain, "zstd"), encodings: []string{"zstd"}, maxSize: 4096},
+		{
+			name:      "stacked",
+			body:      encode(t, encode(t, plain, "gzip"), "br"),
+			encodings: []string{"gzip", "br"},
+			maxSize:   4096,
+		},
+		{name: "unknown", body: plain, encodings: []string{"compress"}, maxSize: 4096, err: errUnsupportedContentEncoding},
+		{name: "bomb", body: encode(t, plain, "gzip"), encodings: []string{"gzip"}, maxSize: 512, err: errDecodedBodyTooLarge},
+	}
+	for _, encoding := range []string{"gzip", "deflate", "br", "zstd"} {
+		t.Run("empty "+encoding, func(t *testing.T) {
+			decoded, err := decodeBody(bytes.NewReader(nil), []string{encoding}, 4096)
+			if err != nil || len(decoded) != 0 {
+				t.Fatalf("expected an empty body, got %q %v", decoded, err)
+			}
+		})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := decodeBody(bytes.NewReader(tt.body), tt.encodings, tt.maxSize)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, plain) {
+				t.Fatalf("expected the plain body, got %q", decoded)
+			}
+		})
+	}
+}
+
+func TestEncodedResponsesWithoutBody(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		switch r.URL.Path {
+		case "/no-content":
+			w.WriteHeader(http.StatusNoContent)
+		case "/not-modified":
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			// Headers only, the server drops the body of HEAD responses
+			w.Header().Set("Content-Length", "128")
+		}
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewHandler(&Config{
+		General: general{
+			AllowedHosts:         []string{"127.0.0.1:*"},
+			AllowedMethods:       []string{http.MethodGet, http.MethodHead},
+			IsEncryptedHeaderKey: "X-Is-Encrypted",
+			SharedKey:            "shared",
+		},
+		Limits: limits{MaxRequestSizeInKB: 1024, MaxResponseSizeInKB: 1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		method   string
+		path     string
+		expected int
+	}{
+		{method: http.MethodHead, path: "/head", expected: http.StatusOK},
+		{method: http.MethodGet, path: "/no-content", expected: http.StatusNoContent},
+		{method: http.MethodGet, path: "/not-modified", expected: http.StatusNotModified},
+	} {
+		r := httptest.NewRequest(tt.method, "/"+upstream.URL+tt.path, nil)
+		r.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		if w.Code != tt.expected {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.expected, w.Code)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package rproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"github.com/samber/lo"
+)
+
+// Algorithms the plaintext of encrypted responses can be compressed with before it's encrypted
+const (
+	CompressionNone   = "none"
+	CompressionGzip   = "gzip"
+	CompressionBrotli = "br"
+)
+
+// The envelope wraps the plaintext when compression is enabled, flagging how it was compressed:
+//
+//	0xff 'R' 'P'  Magic, which can't start a UTF-8 text, so plain payloads aren't mistaken for envelopes
+//	0x01          Version of the envelope
+//	0x00          Compression: 0x00 for none, 0x01 for gzip and 0x02 for brotli
+//	...           Plaintext, compressed or not
+//
+// Payloads without the magic are the plaintext itself, which is what the proxy sends when compression is disabled
+const (
+	envelopeVersion    = 1
+	envelopeHeaderSize = 5
+)
+
+var envelopeMagic = []byte{0xff, 'R', 'P'}
+
+// Compression flags of the envelope, in the same order as the algorithms
+var envelopeCompressions = []string{CompressionNone, CompressionGzip, CompressionBrotli}
+
+var (
+	errUnsupportedCompression      = errors.New("unsupported compression")
+	errUnsupportedEnvelopeVersion  = errors.New("unsupported envelope version")
+	errInvalidEnvelopeHeaderLength = errors.New("invalid envelope header length")
+	errDecompressedTooLarge        = errors.New("decompressed payload is larger than allowed")
+)
+
+// Plaintexts smaller than this aren't compressed, unless another threshold is configured
+const defaultCompressionMinSize = 1024
+
+// DefaultMaxDecompressedSize is how large the plaintext of a compressed envelope is allowed to get once decompressed,
+// so small payloads that decompress into huge ones can't exhaust the memory of whoever decrypts them. The asma VM
+// enforces the same limit
+const DefaultMaxDecompressedSize = 64 << 20
+
+// EncryptCompressed is for encrypting a payload the same way the proxy encrypts its responses when compression is
+// enabled, wrapping the plaintext compressed with one of the Compression algorithms in an envelope
+func EncryptCompressed(authorization, sharedKey string, plaintext []byte, compression string) ([]byte, error) {
+	envelope, err := sealEnvelope(plaintext, compression)
+	if err != nil {
+		return nil, err
+	}
+	return Encrypt(authorization, sharedKey, envelope)
+}
+
+func sealEnvelope(plaintext []byte, compression string) ([]byte, error) {
+	if compression == "" {
+		compression = CompressionNone
+	}
+	flag := lo.IndexOf(envelopeCompressions, compression)
+	if flag < 0 {
+		return nil, fmt.Errorf("%w: %q", errUnsupportedCompression, compression)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(envelopeMagic)
+	buf.WriteByte(envelopeVersion)
+	buf.WriteByte(byte(flag))
+	var w io.WriteCloser
+	switch compression {
+	case CompressionGzip:
+		w = gzip.NewWriter(&buf)
+	case CompressionBrotli:
+		w = brotli.NewWriter(&buf)
+	default:
+		buf.Write(plaintext)
+		return buf.Bytes(), nil
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// openEnvelope is the inverse of sealEnvelope, returning payloads without an envelope as they are. Decompression stops
+// as soon as the plaintext gets larger than maxSize
+func openEnvelope(payload []byte, maxSize int64) ([]byte, error) {
+	if !bytes.HasPrefix(payload, envelopeMagic) {
+		return payload, nil
+	}
+	if len(payload) < envelopeHeaderSize {
+		return nil, errInvalidEnvelopeHeaderLength
+	}
+	if version := payload[len(envelopeMagic)]; version != envelopeVersion {
+		return nil, fmt.Errorf("%w: %d", errUnsupportedEnvelopeVersion, version)
+	}
+	flag, body := int(payload[len(envelopeMagic)+1]), payload[envelopeHeaderSize:]
+	if flag >= len(envelopeCompressions) {
+		return nil, fmt.Errorf("%w: %d", errUnsupportedCompression, flag)
+	}
+
+	var r io.Reader
+	switch envelopeCompressions[flag] {
+	case CompressionGzip:
+		gzr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gzr.Close()
+		r = gzr
+	case CompressionBrotli:
+		r = brotli.NewReader(bytes.NewReader(body))
+	default:
+		return body, nil
+	}
+	plaintext, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(plaintext)) > maxSize {
+		return nil, errDecompressedTooLarge
+	}
+	return plaintext, nil
+}
+
+func (c *compression) validate() error {
+	if !lo.Contains([]string{CompressionGzip, CompressionBrotli}, c.Algorithm) {
+		return fmt.Errorf("%w: %q", errUnsupportedCompression, c.Algorithm)
+	}
+	if c.MinSizeInBytes < 0 {
+		return fmt.Errorf("minSizeInBytes can't be negative")
+	}
+	return nil
+}
+
+func (c *compression) minSize() int {
+	return IfTrueElse(c.MinSizeInBytes > 0, c.MinSizeInBytes, defaultCompressionMinSize)
+}
+
+// compressionFor returns the algorithm the plaintext is compressed with, which is none for the payloads smaller than
+// the threshold since compressing them isn't worth it
+func (c *compression) compressionFor(plaintext []byte) string {
+	if len(plaintext) < c.minSize() {
+		return CompressionNone
+	}
+	return c.Algorithm
+}
+
+// encrypt is for encrypting the plaintext of a response, compressing it first when compression is enabled
+func (h *handler) encrypt(key string, plaintext []byte) ([]byte, error) {
+	if h.compression == nil {
+		return Encrypt(key, h.sharedKey, plaintext)
+	}
+	return EncryptCompressed(key, h.sharedKey, plaintext, h.compression.compressionFor(plaintext))
+}
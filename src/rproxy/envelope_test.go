@@ -0,0 +1,130 @@
+package rproxy
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEncryptCompressed(t *testing.T) {
+	plaintext := []byte(strings.Repeat(`{"ticker":"FNDM3","price":42.0}`, 128))
+	for _, compression := range []string{"", CompressionNone, CompressionGzip, CompressionBrotli} {
+		t.Run(compression, func(t *testing.T) {
+			payload, err := EncryptCompressed("Bearer token", "shared", plaintext, compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := Decrypt("Bearer token", "shared", payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatalf("expected the plaintext back, got %q", decrypted)
+			}
+			if compression != "" && compression != CompressionNone && len(payload) >= len(plaintext) {
+				t.Fatalf("expected the payload to be compressed, got %d bytes out of %d", len(payload), len(plaintext))
+			}
+		})
+	}
+
+	if _, err := EncryptCompressed("", "shared", plaintext, "zstd"); !errors.Is(err, errUnsupportedCompression) {
+		t.Fatalf("expected %v, got %v", errUnsupportedCompression, err)
+	}
+}
+
+func TestOpenEnvelope(t *testing.T) {
+	seal := func(plaintext []byte, compression string) []byte {
+		envelope, err := sealEnvelope(plaintext, compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return envelope
+	}
+	bomb := bytes.Repeat([]byte{0}, 1<<20)
+	tests := []struct {
+		name     string
+		payload  []byte
+		maxSize  int64
+		expected []byte
+		err      error
+	}{
+		{name: "without envelope", payload: []byte(`{"ok":true}`), expected: []byte(`{"ok":true}`)},
+		{name: "without compression", payload: []byte("\xffRP\x01\x00{}"), expected: []byte("{}")},
+		{name: "truncated header", payload: []byte("\xffRP\x01"), err: errInvalidEnvelopeHeaderLength},
+		{name: "unknown version", payload: []byte("\xffRP\x02\x00{}"), err: errUnsupportedEnvelopeVersion},
+		{name: "unknown compression", payload: []byte("\xffRP\x01\x07{}"), err: errUnsupportedCompression},
+		{name: "gzip within the limit", payload: seal(bomb, CompressionGzip), maxSize: 1 << 20, expected: bomb},
+		{name: "gzip bomb", payload: seal(bomb, CompressionGzip), maxSize: 1<<20 - 1, err: errDecompressedTooLarge},
+		{name: "brotli bomb", payload: seal(bomb, CompressionBrotli), maxSize: 1024, err: errDecompressedTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext, err := openEnvelope(tt.payload, IfTrueElse(tt.maxSize > 0, tt.maxSize, DefaultMaxDecompressedSize))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if !bytes.Equal(plaintext, tt.expected) {
+				t.Fatalf("expected %q, got %q", tt.expected, plaintext)
+			}
+		})
+	}
+}
+
+func TestCompression(t *testing.T) {
+	large := strings.Repeat(`{"ticker":"FNDM3"}`, 256)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/small" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(large))
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewHandler(&Config{
+		General: general{
+			AllowedHosts:         []string{"127.0.0.1:*"},
+			AllowedMethods:       []string{http.MethodGet},
+			IsEncryptedHeaderKey: "X-Is-Encrypted",
+			SharedKey:            "shared",
+		},
+		Limits:      limits{MaxRequestSizeInKB: 1024, MaxResponseSizeInKB: 1024},
+		Compression: &compression{Algorithm: CompressionBrotli, MinSizeInBytes: 64},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+		flag     byte
+	}{
+		{path: "/large", expected: large, flag: 2},
+		{path: "/small", expected: `{}`, flag: 0},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/"+upstream.URL+tt.path, nil)
+		r.Header.Set("Authorization", "Bearer token")
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "" {
+			t.Fatalf("%s: expected an encrypted response that isn't gzipped, got %d %v", tt.path, w.Code, w.Header())
+		}
+		plaintext, err := aesDecrypt(aesKey("Bearer token"+"shared"), w.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plaintext) < envelopeHeaderSize || plaintext[envelopeHeaderSize-1] != tt.flag {
+			t.Fatalf("%s: expected the compression flag to be %d, got %q", tt.path, tt.flag, plaintext)
+		}
+		decrypted, err := Decrypt("Bearer token", "shared", w.Body.Bytes())
+		if err != nil || string(decrypted) != tt.expected {
+			t.Fatalf("%s: expected the response to decrypt, got %q %v", tt.path, decrypted, err)
+		}
+	}
+}
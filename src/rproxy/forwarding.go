@@ -0,0 +1,124 @@
+package rproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+const (
+	xForwardedForAppend  = "append"
+	xForwardedForReplace = "replace"
+	xForwardedForNone    = "none"
+)
+
+// Headers identifying the client that are dropped when coming from untrusted clients, along with every other
+// X-Forwarded-* header
+var spoofableHeaders = []string{hXForwardedFor, hXForwardedHost, hXForwardedProto, hXRealIP, hForwarded}
+
+func (f *forwarding) isEnabled() bool {
+	return (f.XForwardedFor != "" && f.XForwardedFor != xForwardedForNone) || f.XForwardedHost || f.XForwardedProto ||
+		f.Forwarded
+}
+
+// setForwardingHeaders is for telling the destination who the client is, as well as how it reached the proxy. The
+// request being sent to the destination already carries a copy of all the headers that came from the client
+func (h *handler) setForwardingHeaders(preq *http.Request, r *http.Request) {
+	isPeerTrusted := h.ipResolver.isPeerTrusted(r)
+	// Whatever identifies the client is set by us from here on, so nothing that came from untrusted clients is kept, even
+	// when none of the headers are managed
+	if !isPeerTrusted {
+		for name := range preq.Header {
+			if lo.Contains(spoofableHeaders, name) || strings.HasPrefix(name, "X-Forwarded-") {
+				preq.Header.Del(name)
+			}
+		}
+	}
+	if !h.forwarding.isEnabled() {
+		return
+	}
+	clientIP := realIP(r)
+
+	// Appending means adding whoever connected to us to the list of the previous proxies, which isn't necessarily the
+	// client when we're behind trusted proxies
+	appendedIP := clientIP
+	if peer := peerIP(r); peer != nil {
+		appendedIP = peer.String()
+	}
+
+	switch h.forwarding.XForwardedFor {
+	case xForwardedForAppend, xForwardedForReplace:
+		forwardedFor := clientIP
+		// If we aren't the first proxy retain prior X-Forwarded-For information as a comma+space separated list and fold
+		// multiple headers into one
+		if prior, ok := preq.Header[hXForwardedFor]; ok && h.forwarding.XForwardedFor == xForwardedForAppend {
+			forwardedFor = strings.Join(prior, ", ") + ", " + appendedIP
+		}
+		preq.Header.Del(hXForwardedFor)
+		preq.Header.Del(hXRealIP)
+		if forwardedFor != "" {
+			preq.Header.Set(hXForwardedFor, forwardedFor)
+		}
+	}
+
+	host, proto := forwardedHost(r, isPeerTrusted), forwardedProto(r, isPeerTrusted)
+	if h.forwarding.XForwardedHost {
+		preq.Header.Set(hXForwardedHost, host)
+	}
+	if h.forwarding.XForwardedProto {
+		preq.Header.Set(hXForwardedProto, proto)
+	}
+
+	if h.forwarding.Forwarded {
+		node, prior := clientIP, preq.Header.Values(hForwarded)
+		if len(prior) > 0 {
+			node = appendedIP
+		}
+		element := "host=" + quoteForwardedValue(host) + ";proto=" + proto
+		if node != "" {
+			element = "for=" + forwardedNode(node) + ";" + element
+		}
+		preq.Header.Set(hForwarded, strings.Join(append(prior, element), ", "))
+	}
+}
+
+// forwardedHost returns the host the client requested the proxy with
+func forwardedHost(r *http.Request, isPeerTrusted bool) string {
+	if prior := r.Header.Get(hXForwardedHost); prior != "" && isPeerTrusted {
+		return prior
+	}
+	return r.Host
+}
+
+// forwardedProto returns the scheme the client requested the proxy with
+func forwardedProto(r *http.Request, isPeerTrusted bool) string {
+	if prior := r.Header.Get(hXForwardedProto); prior != "" && isPeerTrusted {
+		return prior
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	// Requests converted from Lambda events carry the scheme API Gateway was requested with
+	if r.URL.Scheme != "" {
+		return r.URL.Scheme
+	}
+	return "http"
+}
+
+// forwardedNode formats an IP as a node of the `Forwarded` header, where IPv6 addresses go quoted within brackets
+func forwardedNode(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// quoteForwardedValue is for quoting values that aren't valid tokens, such as hosts with a port
+func quoteForwardedValue(value string) string {
+	if strings.ContainsAny(value, `:[]"`) {
+		return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+	}
+	return value
+}
@@ -0,0 +1,113 @@
+package rproxy
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestSetForwardingHeaders(t *testing.T) {
+	trustedProxies, _ := parseTrustedProxies([]string{"10.0.0.0/8"})
+	h := &handler{
+		ipResolver: &ipResolver{trustedProxies: trustedProxies},
+		forwarding: forwarding{XForwardedFor: xForwardedForAppend, XForwardedHost: true, XForwardedProto: true, Forwarded: true},
+	}
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		expected   http.Header
+	}{
+		{
+			name:       "trusted peer",
+			remoteAddr: "10.0.0.1:4711",
+			expected: http.Header{
+				"X-Forwarded-For":   {"198.51.100.7, 2001:db8::1, 10.0.0.1"},
+				"X-Forwarded-Host":  {"rproxy.fundamentei.io"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {`for="[2001:db8::1]", for=10.0.0.1;host=rproxy.fundamentei.io;proto=https`},
+			},
+		},
+		{
+			name:       "untrusted peer",
+			remoteAddr: "203.0.113.9:4711",
+			expected: http.Header{
+				"X-Forwarded-For":   {"203.0.113.9"},
+				"X-Forwarded-Host":  {"localhost:25256"},
+				"X-Forwarded-Proto": {"http"},
+				"Forwarded":         {`for=203.0.113.9;host="localhost:25256";proto=http`},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/https://httpbin.org/json", nil)
+			r.URL.Scheme = ""
+			r.Host = "localhost:25256"
+			r.RemoteAddr = tc.remoteAddr
+			r.Header = http.Header{
+				"X-Forwarded-For":   {"198.51.100.7", "2001:db8::1"},
+				"X-Forwarded-Host":  {"rproxy.fundamentei.io"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Real-Ip":         {"198.51.100.7"},
+				"Forwarded":         {`for="[2001:db8::1]"`},
+			}
+			r = r.WithContext(context.WithValue(r.Context(), realIPContextKey, h.ipResolver.resolve(r)))
+
+			preq, _ := http.NewRequest(http.MethodGet, "https://httpbin.org/json", nil)
+			headerPolicy{}.copy(preq.Header, r.Header)
+			h.setForwardingHeaders(preq, r)
+			for k, v := range tc.expected {
+				if got := preq.Header.Values(k); len(got) != 1 || got[0] != v[0] {
+					t.Errorf("%s: expected %q, got %q", k, v, got)
+				}
+			}
+			if xri := preq.Header.Get(hXRealIP); xri != "" {
+				t.Errorf("expected X-Real-Ip to be dropped, got %q", xri)
+			}
+		})
+	}
+}
+
+func TestSetForwardingHeadersWhenDisabled(t *testing.T) {
+	trustedProxies, _ := parseTrustedProxies([]string{"10.0.0.0/8"})
+	h := &handler{
+		ipResolver: &ipResolver{trustedProxies: trustedProxies},
+		forwarding: forwarding{XForwardedFor: xForwardedForNone},
+	}
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		kept       bool
+	}{
+		{name: "trusted peer", remoteAddr: "10.0.0.1:4711", kept: true},
+		{name: "untrusted peer", remoteAddr: "203.0.113.9:4711", kept: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/https://httpbin.org/json", nil)
+			r.RemoteAddr = tc.remoteAddr
+			r.Header = http.Header{
+				"X-Forwarded-For":    {"198.51.100.7"},
+				"X-Forwarded-Host":   {"rproxy.fundamentei.io"},
+				"X-Forwarded-Port":   {"443"},
+				"X-Forwarded-Prefix": {"/api"},
+				"X-Real-Ip":          {"198.51.100.7"},
+				"Forwarded":          {"for=198.51.100.7"},
+				"Accept":             {"application/json"},
+			}
+			r = r.WithContext(context.WithValue(r.Context(), realIPContextKey, h.ipResolver.resolve(r)))
+
+			preq, _ := http.NewRequest(http.MethodGet, "https://httpbin.org/json", nil)
+			headerPolicy{}.copy(preq.Header, r.Header)
+			h.setForwardingHeaders(preq, r)
+			for name := range r.Header {
+				kept := preq.Header.Get(name) != ""
+				if name == "Accept" && !kept {
+					t.Errorf("expected %s to be kept", name)
+				} else if name != "Accept" && kept != tc.kept {
+					t.Errorf("%s: expected kept to be %v, got %q", name, tc.kept, preq.Header.Get(name))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package rproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/samber/lo"
+)
+
+// How headers are filtered when they're copied over
+const (
+	headerModeDenylist  = "denylist"
+	headerModeAllowlist = "allowlist"
+)
+
+// DefaultOriginalContentTypeHeader is the header the original Content-Type of encrypted responses is sent on, unless
+// another one is configured
+const DefaultOriginalContentTypeHeader = "X-Original-Content-Type"
+
+// Headers of the destination responses passed through to the clients, unless others are configured. Set-Cookie is left
+// out on purpose: every destination shares the origin of the proxy, so a cookie set by one of them would be sent to all
+// the others
+var defaultPassThroughHeaders = []string{
+	"Cache-Control",
+	"Content-Language",
+	"Content-Type",
+	"Expires",
+	"Last-Modified",
+	"Link",
+}
+
+// Headers describing the body as the destination sent it, which no longer apply once it's decoded
+var bodyHeaders = []string{hContentEncoding, hContentLength}
+
+var errEmptyHeaderName = errors.New("header names can't be empty")
+
+func (h *headers) passThrough() []string {
+	return IfTrueElse(len(h.PassThrough) > 0, h.PassThrough, defaultPassThroughHeaders)
+}
+
+func (h *headers) originalContentTypeHeader() string {
+	return IfTrueElse(h.OriginalContentTypeHeader != "", h.OriginalContentTypeHeader, DefaultOriginalContentTypeHeader)
+}
+
+// compileHeaderPatterns is for compiling globs matched against header names, which are case-insensitive
+func compileHeaderPatterns(patterns []string) ([]glob.Glob, error) {
+	compiled := make([]glob.Glob, 0, len(patterns))
+	for _, pattern := range patterns {
+		g, err := glob.Compile(strings.ToLower(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid header pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, g)
+	}
+	return compiled, nil
+}
+
+// passThroughHeaders is for copying the headers of the destination response that are passed through to the client,
+// as long as they also pass the header rules
+func (h *handler) passThroughHeaders(dst, src http.Header, policy headerPolicy) {
+	passed := http.Header{}
+	for name, values := range src {
+		lowered := strings.ToLower(name)
+		if lo.Contains(bodyHeaders, name) || lo.Contains(hopHeaders, name) ||
+			!lo.ContainsBy(h.passThroughPatterns, func(g glob.Glob) bool { return g.Match(lowered) }) {
+			continue
+		}
+		passed[name] = values
+	}
+	policy.copy(dst, passed)
+}
+
+func (rules headerRules) validate() error {
+	if !lo.Contains([]string{"", headerModeDenylist, headerModeAllowlist}, rules.Mode) {
+		return fmt.Errorf("unknown mode %q", rules.Mode)
+	}
+	names := lo.Flatten([][]string{rules.Allow, rules.Deny, rules.Remove, lo.Keys(rules.Set), lo.Keys(rules.Append)})
+	if lo.ContainsBy(names, func(name string) bool { return strings.TrimSpace(name) == "" }) {
+		return errEmptyHeaderName
+	}
+	return nil
+}
+
+// allows tells whether the header passes the allowlist or the denylist
+func (rules headerRules) allows(name string) bool {
+	matches := func(names []string) bool {
+		return lo.ContainsBy(names, func(n string) bool { return strings.EqualFold(n, name) })
+	}
+	if rules.Mode == headerModeAllowlist {
+		return matches(rules.Allow)
+	}
+	return !matches(rules.Deny)
+}
+
+// headerPolicy is every set of header rules that applies to a request, in the order they're applied
+type headerPolicy []headerRules
+
+// copy is for copying the headers that pass all the allowlists and denylists
+func (policy headerPolicy) copy(dst, src http.Header) {
+	for name, values := range src {
+		if !lo.EveryBy(policy, func(rules headerRules) bool { return rules.allows(name) }) {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// rewrite is for removing, setting and then appending headers, filling in the placeholders of the values
+func (policy headerPolicy) rewrite(header http.Header, vars *strings.Replacer) {
+	for _, rules := range policy {
+		for _, name := range rules.Remove {
+			header.Del(name)
+		}
+		for name, value := range rules.Set {
+			header.Set(name, vars.Replace(value))
+		}
+		for name, value := range rules.Append {
+			header.Add(name, vars.Replace(value))
+		}
+	}
+}
+
+// headerTemplateVars is for filling in the placeholders header values can have:
+//
+//	{realIP}     IP of the client
+//	{requestID}  X-Request-Id of the request, or a random one when it came without it
+//	{route}      Name of the policy applied to the destination
+//	{user}       Who the user is according to verified credentials
+//	{host}       Host of the destination
+func headerTemplateVars(r *http.Request, requestID, route, host string) *strings.Replacer {
+	return strings.NewReplacer(
+		"{realIP}", realIP(r),
+		"{requestID}", requestID,
+		"{route}", route,
+		"{user}", requestIdentity(r).user,
+		"{host}", host,
+	)
+}
+
+// requestID returns the ID the request came with, generating one when there's none
+func requestID(r *http.Request) string {
+	if id := strings.TrimSpace(r.Header.Get(hXRequestID)); id != "" {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,164 @@
+package rproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/samber/lo"
+)
+
+func TestHeaderPolicy(t *testing.T) {
+	src := http.Header{
+		"Accept":          {"application/json"},
+		"Authorization":   {"token"},
+		"Cookie":          {"session=secret"},
+		"X-Debug":         {"1"},
+		"X-Forwarded-For": {"203.0.113.7"},
+	}
+
+	tests := []struct {
+		name     string
+		policy   headerPolicy
+		expected http.Header
+	}{
+		{
+			name:     "denylist",
+			policy:   headerPolicy{{Deny: []string{"cookie", "X-Debug"}}},
+			expected: http.Header{"Accept": {"application/json"}, "Authorization": {"token"}, "X-Forwarded-For": {"203.0.113.7"}},
+		},
+		{
+			name:     "allowlist",
+			policy:   headerPolicy{{Mode: headerModeAllowlist, Allow: []string{"accept", "Authorization"}}},
+			expected: http.Header{"Accept": {"application/json"}, "Authorization": {"token"}},
+		},
+		{
+			name: "every set of rules applies",
+			policy: headerPolicy{
+				{Mode: headerModeAllowlist, Allow: []string{"Accept", "Authorization", "Cookie"}},
+				{Deny: []string{"Cookie"}},
+			},
+			expected: http.Header{"Accept": {"application/json"}, "Authorization": {"token"}},
+		},
+		{
+			name: "rewrite",
+			policy: headerPolicy{
+				{Mode: headerModeAllowlist, Allow: []string{"Accept"}, Set: map[string]string{"Accept": "text/plain"}},
+				{
+					Remove: []string{"Accept"},
+					Set:    map[string]string{"X-Client-Ip": "{realIP}", "X-Route": "{route} on {host}"},
+					Append: map[string]string{"Via": "rproxy {requestID}"},
+				},
+			},
+			expected: http.Header{
+				"X-Client-Ip": {"198.51.100.7"},
+				"X-Route":     {"reports on api.fundamentei.io"},
+				"Via":         {"1.1 cdn", "rproxy request-1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/https://api.fundamentei.io/json", nil)
+			r = r.WithContext(context.WithValue(r.Context(), realIPContextKey, "198.51.100.7"))
+			r.Header.Set(hXRequestID, "request-1")
+
+			dst := http.Header{}
+			tt.policy.copy(dst, src)
+			if tt.name == "rewrite" {
+				dst.Set("Via", "1.1 cdn")
+			}
+			tt.policy.rewrite(dst, headerTemplateVars(r, requestID(r), "reports", "api.fundamentei.io"))
+			if !reflect.DeepEqual(dst, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, dst)
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/https://api.fundamentei.io/json", nil)
+	if id := requestID(r); len(id) != 32 || id == requestID(r) {
+		t.Fatalf("expected a random request ID, got %q", id)
+	}
+	r.Header.Set(hXRequestID, "request-1")
+	if id := requestID(r); id != "request-1" {
+		t.Fatalf("expected the request ID to be kept, got %q", id)
+	}
+}
+
+func TestPassThroughHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("X-Fndm-Version", "1")
+		w.Header().Set("Server", "upstream")
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewHandler(&Config{
+		General: general{
+			AllowedHosts:         []string{"127.0.0.1:*"},
+			AllowedMethods:       []string{http.MethodGet},
+			IsEncryptedHeaderKey: "X-Is-Encrypted",
+			SharedKey:            "shared",
+		},
+		Limits: limits{MaxRequestSizeInKB: 1024, MaxResponseSizeInKB: 1024},
+		Headers: headers{
+			PassThrough: []string{"content-type", "Cache-Control", "Set-Cookie", "X-Fndm-*"},
+			Response:    headerRules{Deny: []string{"Set-Cookie"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("X-Is-Encrypted") != "true" {
+		t.Fatalf("expected an encrypted response, got %d %v", w.Code, w.Header())
+	}
+	expected := map[string]string{
+		"Content-Type":                   "application/octet-stream",
+		DefaultOriginalContentTypeHeader: "application/json",
+		"Cache-Control":                  "no-store",
+		"X-Fndm-Version":                 "1",
+		"Set-Cookie":                     "",
+		"Server":                         "",
+	}
+	for name, value := range expected {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("expected %s to be %q, got %q", name, value, got)
+		}
+	}
+	if vary := w.Header().Values("Vary"); !lo.Contains(vary, "Authorization") || !lo.Contains(vary, "X-Api-Key") {
+		t.Errorf("expected encrypted responses to vary by credentials, got %q", vary)
+	}
+	body, err := Decrypt("Bearer token", "shared", w.Body.Bytes())
+	if err != nil || string(body) != `{}` {
+		t.Fatalf("expected the response to decrypt, got %q %v", body, err)
+	}
+}
+
+func TestDefaultPassThroughHeaders(t *testing.T) {
+	patterns, err := compileHeaderPatterns((&headers{}).passThrough())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handler{passThroughPatterns: patterns}
+	dst := http.Header{}
+	h.passThroughHeaders(dst, http.Header{
+		"Cache-Control":  {"no-store"},
+		"Content-Length": {"2"},
+		"Set-Cookie":     {"session=secret"},
+	}, headerPolicy{})
+	if expected := (http.Header{"Cache-Control": {"no-store"}}); !reflect.DeepEqual(dst, expected) {
+		t.Fatalf("expected %v, got %v", expected, dst)
+	}
+}
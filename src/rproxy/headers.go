@@ -5,6 +5,22 @@ import "net/http"
 var (
 	hContentEncoding = http.CanonicalHeaderKey("Content-Encoding")
 	hContentLength   = http.CanonicalHeaderKey("Content-Length")
+	hContentType     = http.CanonicalHeaderKey("Content-Type")
+	hVary            = http.CanonicalHeaderKey("Vary")
 	hAuthorization   = http.CanonicalHeaderKey("Authorization")
 	hXForwardedFor   = http.CanonicalHeaderKey("X-Forwarded-For")
+	hXForwardedHost  = http.CanonicalHeaderKey("X-Forwarded-Host")
+	hXForwardedProto = http.CanonicalHeaderKey("X-Forwarded-Proto")
+	hXRealIP         = http.CanonicalHeaderKey("X-Real-Ip")
+	hForwarded       = http.CanonicalHeaderKey("Forwarded")
+	hOrigin          = http.CanonicalHeaderKey("Origin")
+	hReferer         = http.CanonicalHeaderKey("Referer")
+	hSecFetchSite    = http.CanonicalHeaderKey("Sec-Fetch-Site")
+	hXRequestID      = http.CanonicalHeaderKey("X-Request-Id")
+	hXAPIKey         = http.CanonicalHeaderKey("X-Api-Key")
+
+	hAccessControlAllowOrigin = http.CanonicalHeaderKey("Access-Control-Allow-Origin")
+	// Private Network Access (https://wicg.github.io/private-network-access)
+	hAccessControlRequestPrivateNetwork = http.CanonicalHeaderKey("Access-Control-Request-Private-Network")
+	hAccessControlAllowPrivateNetwork   = http.CanonicalHeaderKey("Access-Control-Allow-Private-Network")
 )
@@ -0,0 +1,131 @@
+package rproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var errMissingCredentials = errors.New("missing credentials")
+
+// identity is who made the request, as far as the credentials that came with it tell
+type identity struct {
+	// Identifies the user in quotas and rate limits. Empty for anonymous requests
+	subject string
+	// Whether the subject comes from credentials that were verified, such as a token or a known API key
+	verified bool
+	// Who the user is according to verified credentials, shown in the access logs
+	user string
+	// Quota tier assigned to the user. Empty means the default one
+	tier string
+	// API key the request was made with, if any
+	apiKey *compiledAPIKey
+	// What the encryption key is derived from instead of the Authorization header, when set
+	keyMaterial string
+	// Why the credentials that came with the request were rejected
+	err error
+}
+
+// hashedSubject is for identifying users by a credential without keeping it around
+func hashedSubject(kind, credential string) string {
+	hash := sha256.Sum256([]byte(credential))
+	return kind + ":" + hex.EncodeToString(hash[:])
+}
+
+// authenticate is for finding out who made the request. API keys take precedence over the Authorization header, which
+// is taken as is without JWT verification, since it's only used as key material
+func (h *handler) authenticate(r *http.Request) *identity {
+	if key := strings.TrimSpace(r.Header.Get(hXAPIKey)); key != "" && len(h.apiKeys) > 0 {
+		return h.authenticateAPIKey(key)
+	}
+	authorization := strings.TrimSpace(r.Header.Get(hAuthorization))
+	if authorization == "" {
+		return &identity{}
+	}
+	if h.jwtVerifier == nil {
+		return &identity{subject: hashedSubject("authorization", authorization)}
+	}
+
+	claims, err := h.jwtVerifier.verify(authorization)
+	if err != nil {
+		return &identity{err: err}
+	}
+	id := &identity{user: claims.string("sub"), verified: true}
+	// Tokens get renewed, so the subject is preferred to keep the usage of the user together
+	id.subject = IfTrueElse(id.user != "", "jwt:"+id.user, hashedSubject("authorization", authorization))
+	if claim := h.jwtVerifier.opts.TierClaim; claim != "" {
+		id.tier = claims.string(claim)
+	}
+	if claim := h.jwtVerifier.opts.EncryptionKeyClaim; claim != "" {
+		if id.keyMaterial = claims.string(claim); id.keyMaterial == "" {
+			return &identity{err: fmt.Errorf("missing %s claim", claim)}
+		}
+	}
+	return id
+}
+
+// withIdentity is for authenticating the request once, so the identity is available through requestIdentity. Requests
+// with rejected credentials still go through, it's up to the handler to turn them down, so they're logged as usual
+func (h *handler) withIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), identityContextKey, h.authenticate(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestIdentity returns the identity established by withIdentity
+func requestIdentity(r *http.Request) *identity {
+	if id, ok := r.Context().Value(identityContextKey).(*identity); ok {
+		return id
+	}
+	return (&handler{}).authenticate(r)
+}
+
+// verifiedSubject returns the subject of the request when its credentials were verified, or the client IP otherwise.
+// Credentials that weren't verified can be made up on every request, so they can't be relied on for limiting anyone
+func verifiedSubject(r *http.Request) string {
+	if id := requestIdentity(r); id.verified && id.subject != "" {
+		return id.subject
+	}
+	return "ip:" + realIP(r)
+}
+
+// requireAuthentication is for turning down requests with rejected credentials, and anonymous ones when tokens are
+// required. It writes the response and returns false in that case
+func (h *handler) requireAuthentication(w http.ResponseWriter, r *http.Request) bool {
+	id := requestIdentity(r)
+	if id.err == nil && (id.subject != "" || h.jwtVerifier == nil || h.jwtVerifier.opts.AllowAnonymous) {
+		return true
+	}
+
+	err := id.err
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	if err == nil {
+		err = errMissingCredentials
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	log.Printf("Couldn't authenticate the request from %s: %v", realIP(r), err)
+	return false
+}
+
+// tierOf returns the tier of the user that made the request, which is the default quota tier unless one was assigned
+func (h *handler) tierOf(r *http.Request) string {
+	if tier := requestIdentity(r).tier; tier != "" || h.quotas == nil {
+		return tier
+	}
+	return h.quotas.DefaultTier
+}
+
+// encryptionKeyMaterial returns what the encryption key of the response is derived from, along with the shared key
+func encryptionKeyMaterial(r *http.Request) string {
+	if id := requestIdentity(r); id.keyMaterial != "" {
+		return id.keyMaterial
+	}
+	return strings.TrimSpace(r.Header.Get(hAuthorization))
+}
@@ -0,0 +1,332 @@
+package rproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// Signing algorithms tokens can be verified with
+const (
+	jwtHS256 = "HS256"
+	jwtRS256 = "RS256"
+	jwtES256 = "ES256"
+)
+
+var jwtAlgorithms = []string{jwtHS256, jwtRS256, jwtES256}
+
+var (
+	errMalformedJWT        = errors.New("malformed token")
+	errInvalidJWTSignature = errors.New("invalid token signature")
+)
+
+func (opts *jwtOptions) validate() error {
+	if len(opts.Algorithms) == 0 {
+		return errors.New("algorithms can't be empty")
+	}
+	for _, alg := range opts.Algorithms {
+		if !lo.Contains(jwtAlgorithms, alg) {
+			return fmt.Errorf("unsupported algorithm %q", alg)
+		}
+	}
+	if lo.Contains(opts.Algorithms, jwtHS256) && opts.HMACSecret == "" {
+		return errors.New("hmacSecret is required for HS256")
+	}
+	usesPublicKeys := lo.Contains(opts.Algorithms, jwtRS256) || lo.Contains(opts.Algorithms, jwtES256)
+	if usesPublicKeys && len(opts.PublicKeyFiles) == 0 && opts.JWKSFile == "" {
+		return errors.New("publicKeyFiles or jwksFile is required for RS256 and ES256")
+	}
+	return nil
+}
+
+// jwtKey is a public key tokens can be verified with. Keys without an ID are tried for every token
+type jwtKey struct {
+	id  string
+	key crypto.PublicKey
+}
+
+// jwtVerifier is for verifying the signature and the registered claims of JSON Web Tokens
+type jwtVerifier struct {
+	opts *jwtOptions
+	keys []jwtKey
+	now  func() time.Time
+}
+
+func newJWTVerifier(opts *jwtOptions) (*jwtVerifier, error) {
+	v := &jwtVerifier{opts: opts, now: time.Now}
+	for _, file := range opts.PublicKeyFiles {
+		keys, err := loadPEMPublicKeys(file)
+		if err != nil {
+			return nil, fmt.Errorf("jwt.publicKeyFiles: %w", err)
+		}
+		v.keys = append(v.keys, keys...)
+	}
+	if opts.JWKSFile != "" {
+		keys, err := loadJWKS(opts.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("jwt.jwksFile: %w", err)
+		}
+		v.keys = append(v.keys, keys...)
+	}
+	return v, nil
+}
+
+// jwtClaims are the claims of a verified token. Numbers are kept as json.Number
+type jwtClaims map[string]interface{}
+
+// verify is for checking the token was signed with one of the keys and is currently valid, returning its claims. The
+// token may come prefixed by "Bearer "
+func (v *jwtVerifier) verify(token string) (jwtClaims, error) {
+	token = strings.TrimSpace(token)
+	if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedJWT
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	// The algorithm comes from the token itself, so only the configured ones can be trusted. Otherwise it could be "none"
+	if !lo.Contains(v.opts.Algorithms, header.Alg) {
+		return nil, fmt.Errorf("algorithm %q isn't accepted", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedJWT
+	}
+	if err := v.verifySignature(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	claims := jwtClaims{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *jwtVerifier) verifySignature(alg, kid string, signed, signature []byte) error {
+	if alg == jwtHS256 {
+		mac := hmac.New(sha256.New, []byte(v.opts.HMACSecret))
+		mac.Write(signed)
+		if hmac.Equal(signature, mac.Sum(nil)) {
+			return nil
+		}
+		return errInvalidJWTSignature
+	}
+
+	digest := sha256.Sum256(signed)
+	for _, k := range v.keys {
+		if kid != "" && k.id != "" && k.id != kid {
+			continue
+		}
+		switch key := k.key.(type) {
+		case *rsa.PublicKey:
+			if alg == jwtRS256 && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			// ES256 signatures are the concatenation of R and S, 32 bytes each
+			if alg == jwtES256 && key.Curve == elliptic.P256() && len(signature) == 64 {
+				r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+				if ecdsa.Verify(key, digest[:], r, s) {
+					return nil
+				}
+			}
+		}
+	}
+	return errInvalidJWTSignature
+}
+
+func (v *jwtVerifier) validateClaims(claims jwtClaims) error {
+	now := v.now()
+	leeway := seconds(v.opts.Leeway)
+	exp, ok := claims.time("exp")
+	if !ok {
+		return errors.New("missing exp claim")
+	}
+	if !now.Before(exp.Add(leeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(leeway).Before(nbf) {
+		return errors.New("token isn't valid yet")
+	}
+	if v.opts.Issuer != "" && claims.string("iss") != v.opts.Issuer {
+		return fmt.Errorf("unexpected issuer %q", claims.string("iss"))
+	}
+	if len(v.opts.Audience) > 0 && !lo.Some(v.opts.Audience, claims.audience()) {
+		return fmt.Errorf("unexpected audience %q", claims.audience())
+	}
+	return nil
+}
+
+// string returns the claim as a string, numbers included. Missing claims and other types are returned as empty
+func (c jwtClaims) string(name string) string {
+	switch value := c[name].(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	}
+	return ""
+}
+
+// time returns a NumericDate claim, which are seconds since the epoch
+func (c jwtClaims) time(name string) (time.Time, bool) {
+	value, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	secs, err := value.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(secs), 0), true
+}
+
+// audience returns the "aud" claim, which can either be a single string or an array of them
+func (c jwtClaims) audience() []string {
+	switch value := c["aud"].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		return lo.FilterMap(value, func(v interface{}, _ int) (string, bool) {
+			s, ok := v.(string)
+			return s, ok
+		})
+	}
+	return nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errMalformedJWT
+	}
+	d := json.NewDecoder(strings.NewReader(string(data)))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return errMalformedJWT
+	}
+	return nil
+}
+
+// loadPEMPublicKeys is for reading every public key in a PEM file, either as is or within certificates
+func loadPEMPublicKeys(file string) ([]jwtKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []jwtKey
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		var key crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		keys = append(keys, jwtKey{key: key})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no public keys found", file)
+	}
+	return keys, nil
+}
+
+// loadJWKS is for reading the RSA and P-256 keys of a JSON Web Key Set file (RFC 7517). Keys meant for anything other
+// than signatures are left out
+func loadJWKS(file string) ([]jwtKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	var keys []jwtKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch {
+		case jwk.Kty == "RSA":
+			n, errN := decodeJWKInt(jwk.N)
+			e, errE := decodeJWKInt(jwk.E)
+			if errN != nil || errE != nil || !e.IsInt64() {
+				return nil, fmt.Errorf("%s: invalid RSA key %q", file, jwk.Kid)
+			}
+			keys = append(keys, jwtKey{id: jwk.Kid, key: &rsa.PublicKey{N: n, E: int(e.Int64())}})
+		case jwk.Kty == "EC" && jwk.Crv == "P-256":
+			x, errX := decodeJWKInt(jwk.X)
+			y, errY := decodeJWKInt(jwk.Y)
+			if errX != nil || errY != nil || !elliptic.P256().IsOnCurve(x, y) {
+				return nil, fmt.Errorf("%s: invalid EC key %q", file, jwk.Kid)
+			}
+			keys = append(keys, jwtKey{id: jwk.Kid, key: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no RSA or P-256 signing keys found", file)
+	}
+	return keys, nil
+}
+
+func decodeJWKInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,167 @@
+package rproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": alg, "typ": "JWT", "kid": kid}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	t.Helper()
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		},
+	}
+	data, _ := json.Marshal(jwks)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestJWTVerifier(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	secret := []byte("a-very-secret-secret")
+
+	v, err := newJWTVerifier(&jwtOptions{
+		Algorithms: []string{jwtHS256, jwtRS256, jwtES256},
+		HMACSecret: string(secret),
+		JWKSFile:   writeJWKS(t, rsaKey, ecKey),
+		Issuer:     "https://auth.fundamentei.io",
+		Audience:   []string{"rproxy"},
+		Leeway:     30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1666000000, 0)
+	v.now = func() time.Time { return now }
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "user-1",
+			"iss": "https://auth.fundamentei.io",
+			"aud": []string{"web", "rproxy"},
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"HS256", signJWT(t, jwtHS256, "", secret, claims(nil)), true},
+		{"RS256", "Bearer " + signJWT(t, jwtRS256, "rsa", rsaKey, claims(nil)), true},
+		{"ES256", signJWT(t, jwtES256, "ec", ecKey, claims(nil)), true},
+		{"ES256 without kid", signJWT(t, jwtES256, "", ecKey, claims(nil)), true},
+		{"audience as a string", signJWT(t, jwtHS256, "", secret, claims(map[string]interface{}{"aud": "rproxy"})), true},
+		{"expired within the leeway", signJWT(t, jwtHS256, "", secret, claims(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()})), true},
+		{"expired", signJWT(t, jwtHS256, "", secret, claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})), false},
+		{"without exp", signJWT(t, jwtHS256, "", secret, claims(map[string]interface{}{"exp": nil})), false},
+		{"not valid yet", signJWT(t, jwtHS256, "", secret, claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})), false},
+		{"wrong issuer", signJWT(t, jwtHS256, "", secret, claims(map[string]interface{}{"iss": "https://evil.com"})), false},
+		{"wrong audience", signJWT(t, jwtHS256, "", secret, claims(map[string]interface{}{"aud": "another"})), false},
+		{"wrong secret", signJWT(t, jwtHS256, "", []byte("guessed"), claims(nil)), false},
+		{"key of another kid", signJWT(t, jwtRS256, "ec", rsaKey, claims(nil)), false},
+		{"algorithm mismatch", signJWT(t, jwtES256, "rsa", rsaKey, claims(nil)), false},
+		{"none algorithm", signJWT(t, "none", "", nil, claims(nil)), false},
+		{"garbage", "Bearer garbage", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := v.verify(tt.token)
+			if tt.valid && (err != nil || got.string("sub") != "user-1") {
+				t.Fatalf("expected the token to be valid, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("expected the token to be rejected")
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	secret := []byte("a-very-secret-secret")
+	h := &handler{}
+	h.jwtVerifier, _ = newJWTVerifier(&jwtOptions{
+		Algorithms:         []string{jwtHS256},
+		HMACSecret:         string(secret),
+		EncryptionKeyClaim: "sub",
+		TierClaim:          "plan",
+	})
+
+	exp := time.Now().Add(time.Hour).Unix()
+	token := signJWT(t, jwtHS256, "", secret, map[string]interface{}{"sub": "user-1", "plan": "pro", "exp": exp})
+	r := httptest.NewRequest(http.MethodGet, "/https://httpbin.org/json", nil)
+	r.Header.Set(hAuthorization, token)
+	id := h.authenticate(r)
+	if id.err != nil || id.subject != "jwt:user-1" || id.user != "user-1" || id.tier != "pro" || id.keyMaterial != "user-1" {
+		t.Fatalf("unexpected identity %+v", id)
+	}
+
+	// The encryption key can't be derived without the claim
+	token = signJWT(t, jwtHS256, "", secret, map[string]interface{}{"exp": exp})
+	r.Header.Set(hAuthorization, token)
+	if id := h.authenticate(r); id.err == nil {
+		t.Fatalf("expected the token to be rejected, got %+v", id)
+	}
+
+	r.Header.Del(hAuthorization)
+	if id := h.authenticate(r); id.err != nil || id.subject != "" {
+		t.Fatalf("expected an anonymous identity, got %+v", id)
+	}
+}
@@ -0,0 +1,216 @@
+package rproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awslabs/aws-lambda-go-api-proxy/httpadapter"
+	"github.com/samber/lo"
+)
+
+// The event formats the proxy can be invoked with on AWS Lambda
+const (
+	// Detects the format out of each event
+	LambdaEventFormatAuto = "auto"
+	// API Gateway REST APIs (payload format version 1.0)
+	LambdaEventFormatAPIGatewayV1 = "apigateway-v1"
+	// API Gateway HTTP APIs (payload format version 2.0)
+	LambdaEventFormatAPIGatewayV2 = "apigateway-v2"
+	// Lambda function URLs, which share the payload format of HTTP APIs
+	LambdaEventFormatFunctionURL = "function-url"
+	// Application Load Balancer target groups
+	LambdaEventFormatALB = "alb"
+)
+
+var lambdaEventFormats = []string{
+	LambdaEventFormatAuto,
+	LambdaEventFormatAPIGatewayV1,
+	LambdaEventFormatAPIGatewayV2,
+	LambdaEventFormatFunctionURL,
+	LambdaEventFormatALB,
+}
+
+// LambdaHandler is the function handed over to `lambda.Start`
+type LambdaHandler func(ctx context.Context, event json.RawMessage) (interface{}, error)
+
+// NewLambdaHandler is for creating a Lambda function handler that converts the events of the given format into HTTP
+// requests served by the handler, and its responses back into the format expected by the invoker
+func NewLambdaHandler(handler http.Handler, format string) (LambdaHandler, error) {
+	if format == "" {
+		format = LambdaEventFormatAuto
+	}
+	if !lo.Contains(lambdaEventFormats, format) {
+		return nil, fmt.Errorf("unknown Lambda event format %q", format)
+	}
+
+	v1 := httpadapter.New(handler)
+	v2 := httpadapter.NewV2(handler)
+	return func(ctx context.Context, event json.RawMessage) (interface{}, error) {
+		eventFormat := format
+		if eventFormat == LambdaEventFormatAuto {
+			detected, err := detectLambdaEventFormat(event)
+			if err != nil {
+				return nil, err
+			}
+			eventFormat = detected
+		}
+
+		switch eventFormat {
+		case LambdaEventFormatAPIGatewayV1:
+			var req events.APIGatewayProxyRequest
+			if err := json.Unmarshal(event, &req); err != nil {
+				return nil, err
+			}
+			return v1.ProxyWithContext(ctx, req)
+		case LambdaEventFormatAPIGatewayV2, LambdaEventFormatFunctionURL:
+			var req events.APIGatewayV2HTTPRequest
+			if err := json.Unmarshal(event, &req); err != nil {
+				return nil, err
+			}
+			return v2.ProxyWithContext(ctx, req)
+		default:
+			var req events.ALBTargetGroupRequest
+			if err := json.Unmarshal(event, &req); err != nil {
+				return nil, err
+			}
+			return proxyALB(ctx, handler, req)
+		}
+	}, nil
+}
+
+// detectLambdaEventFormat is for telling the event formats apart based on the fields that are unique to each of them
+func detectLambdaEventFormat(event json.RawMessage) (string, error) {
+	var probe struct {
+		Version        string `json:"version"`
+		HTTPMethod     string `json:"httpMethod"`
+		RequestContext struct {
+			ELB *json.RawMessage `json:"elb"`
+		} `json:"requestContext"`
+	}
+	if err := json.Unmarshal(event, &probe); err != nil {
+		return "", err
+	}
+	switch {
+	case probe.RequestContext.ELB != nil:
+		return LambdaEventFormatALB, nil
+	case probe.Version == "2.0":
+		return LambdaEventFormatAPIGatewayV2, nil
+	case probe.HTTPMethod != "":
+		return LambdaEventFormatAPIGatewayV1, nil
+	}
+	return "", errors.New("couldn't detect the format of the Lambda event")
+}
+
+// proxyALB is for serving events coming from an Application Load Balancer. Headers and query string parameters come
+// as multiple values only when enabled on the target group, in which case the response must use them as well
+func proxyALB(ctx context.Context, handler http.Handler, event events.ALBTargetGroupRequest) (events.ALBTargetGroupResponse, error) {
+	body := []byte(event.Body)
+	if event.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(event.Body)
+		if err != nil {
+			return events.ALBTargetGroupResponse{}, err
+		}
+		body = decoded
+	}
+
+	header := http.Header{}
+	if event.MultiValueHeaders != nil {
+		for k, values := range event.MultiValueHeaders {
+			for _, v := range values {
+				header.Add(k, v)
+			}
+		}
+	} else {
+		for k, v := range event.Headers {
+			header.Add(k, v)
+		}
+	}
+
+	// The load balancer doesn't decode the path nor the query string parameters, so they're used as they are
+	requestURI := event.Path
+	if !strings.HasPrefix(requestURI, "/") {
+		requestURI = "/" + requestURI
+	}
+	var query []string
+	if event.MultiValueQueryStringParameters != nil {
+		for k, values := range event.MultiValueQueryStringParameters {
+			for _, v := range values {
+				query = append(query, k+"="+v)
+			}
+		}
+	} else {
+		for k, v := range event.QueryStringParameters {
+			query = append(query, k+"="+v)
+		}
+	}
+	if len(query) > 0 {
+		sort.Strings(query)
+		requestURI += "?" + strings.Join(query, "&")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, event.HTTPMethod, "https://"+header.Get("Host")+requestURI, bytes.NewReader(body))
+	if err != nil {
+		return events.ALBTargetGroupResponse{}, err
+	}
+	req.Header = header
+	req.RequestURI = requestURI
+
+	w := &lambdaResponseWriter{header: http.Header{}}
+	handler.ServeHTTP(w, req)
+
+	res := events.ALBTargetGroupResponse{
+		StatusCode:        w.statusCode(),
+		StatusDescription: fmt.Sprintf("%d %s", w.statusCode(), http.StatusText(w.statusCode())),
+	}
+	if event.MultiValueHeaders != nil {
+		res.MultiValueHeaders = w.header
+	} else {
+		res.Headers = make(map[string]string, len(w.header))
+		for k, values := range w.header {
+			res.Headers[k] = strings.Join(values, ",")
+		}
+	}
+	// Encrypted responses are binary, which needs to be encoded to go through the load balancer
+	if utf8.Valid(w.body.Bytes()) {
+		res.Body = w.body.String()
+	} else {
+		res.Body = base64.StdEncoding.EncodeToString(w.body.Bytes())
+		res.IsBase64Encoded = true
+	}
+	return res, nil
+}
+
+// lambdaResponseWriter buffers the response so it can be returned as an event
+type lambdaResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *lambdaResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *lambdaResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+func (w *lambdaResponseWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(data)
+}
+
+func (w *lambdaResponseWriter) statusCode() int {
+	return IfTrueElse(w.status == 0, http.StatusOK, w.status)
+}
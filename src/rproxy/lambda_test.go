@@ -0,0 +1,126 @@
+package rproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Binary on purpose, the same way encrypted responses are
+var lambdaTestResponseBody = []byte{0xde, 0xad, 0xbe, 0xef}
+
+func lambdaTestHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyToURL, err := requestURIToProxyURL(r.RequestURI)
+		if err != nil || proxyToURL.String() != "https://httpbin.org/anything" {
+			t.Errorf("unexpected request URI: %q", r.RequestURI)
+		}
+		if body, _ := io.ReadAll(r.Body); string(body) != `{"hello":"world"}` {
+			t.Errorf("unexpected body: %q", body)
+		}
+		if authorization := r.Header.Get(hAuthorization); authorization != "Bearer token" {
+			t.Errorf("unexpected authorization: %q", authorization)
+		}
+		w.Header().Add("X-Custom", "first")
+		w.Header().Add("X-Custom", "second")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(lambdaTestResponseBody)
+	})
+}
+
+func TestLambdaHandler(t *testing.T) {
+	for _, tc := range []struct {
+		fixture string
+		format  string
+		check   func(t *testing.T, res interface{})
+	}{
+		{
+			fixture: "apigateway-v1.json",
+			format:  LambdaEventFormatAPIGatewayV1,
+			check: func(t *testing.T, res interface{}) {
+				r := res.(events.APIGatewayProxyResponse)
+				checkLambdaResponse(t, r.StatusCode, r.Body, r.IsBase64Encoded)
+				if strings.Join(r.MultiValueHeaders["X-Custom"], ",") != "first,second" {
+					t.Errorf("unexpected headers: %v", r.MultiValueHeaders)
+				}
+			},
+		},
+		{
+			fixture: "apigateway-v2.json",
+			format:  LambdaEventFormatAPIGatewayV2,
+			check: func(t *testing.T, res interface{}) {
+				r := res.(events.APIGatewayV2HTTPResponse)
+				checkLambdaResponse(t, r.StatusCode, r.Body, r.IsBase64Encoded)
+				if r.Headers["X-Custom"] != "first,second" {
+					t.Errorf("unexpected headers: %v", r.Headers)
+				}
+			},
+		},
+		{
+			fixture: "function-url.json",
+			format:  LambdaEventFormatFunctionURL,
+			check: func(t *testing.T, res interface{}) {
+				r := res.(events.APIGatewayV2HTTPResponse)
+				checkLambdaResponse(t, r.StatusCode, r.Body, r.IsBase64Encoded)
+			},
+		},
+		{
+			fixture: "alb.json",
+			format:  LambdaEventFormatALB,
+			check: func(t *testing.T, res interface{}) {
+				r := res.(events.ALBTargetGroupResponse)
+				checkLambdaResponse(t, r.StatusCode, r.Body, r.IsBase64Encoded)
+				if r.StatusDescription != "201 Created" || r.Headers["X-Custom"] != "first,second" || r.MultiValueHeaders != nil {
+					t.Errorf("unexpected response: %+v", r)
+				}
+			},
+		},
+		{
+			fixture: "alb-multi-value.json",
+			format:  LambdaEventFormatALB,
+			check: func(t *testing.T, res interface{}) {
+				r := res.(events.ALBTargetGroupResponse)
+				checkLambdaResponse(t, r.StatusCode, r.Body, r.IsBase64Encoded)
+				if strings.Join(r.MultiValueHeaders["X-Custom"], ",") != "first,second" || r.Headers != nil {
+					t.Errorf("unexpected response: %+v", r)
+				}
+			},
+		},
+	} {
+		t.Run(tc.fixture, func(t *testing.T) {
+			event, err := os.ReadFile(filepath.Join("testdata", "lambda", tc.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Both the explicitly configured format and the detected one must work the same
+			for _, format := range []string{tc.format, LambdaEventFormatAuto} {
+				lambdaHandler, err := NewLambdaHandler(lambdaTestHandler(t), format)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res, err := lambdaHandler(context.Background(), event)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tc.check(t, res)
+			}
+		})
+	}
+}
+
+func checkLambdaResponse(t *testing.T, statusCode int, body string, isBase64Encoded bool) {
+	t.Helper()
+	if statusCode != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, statusCode)
+	}
+	if !isBase64Encoded || body != base64.StdEncoding.EncodeToString(lambdaTestResponseBody) {
+		t.Errorf("unexpected body: %q (base64: %v)", body, isBase64Encoded)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"log"
 	"net/http"
 	"time"
+
+	"github.com/NYTimes/gziphandler"
 )
 
 // dodgeFaviconRequest is for skipping "favicon.ico" requests when the proxy is open via browser for debugging purposes
@@ -34,8 +36,18 @@ func logIncomingRequest(handler http.Handler) http.Handler {
 			logProxyToURL = "-"
 		}
 
-		log.Printf("HTTP - %s - - %s \"%s %s %s\" %d %d %s %0.2fs\n",
+		// Identifies the client the same way the "authuser" field of the common log format does
+		logClientIdentity := clientCertCommonName(r)
+		if logClientIdentity == "" {
+			logClientIdentity = requestIdentity(r).user
+		}
+		if logClientIdentity == "" {
+			logClientIdentity = "-"
+		}
+
+		log.Printf("HTTP - %s - %s %s \"%s %s %s\" %d %d %s %0.2fs\n",
 			realIP(r),
+			logClientIdentity,
 			start.Format("02/Jan/2006:15:04:05 -0700"),
 			r.Method,
 			logProxyToURL,
@@ -47,3 +59,16 @@ func logIncomingRequest(handler http.Handler) http.Handler {
 		)
 	})
 }
+
+// withCompression is for gzipping the responses of the destinations that aren't encrypted. Encrypted responses are
+// left alone since ciphertext doesn't compress, which is what the compression section is for
+func (h *handler) withCompression(next http.Handler) http.Handler {
+	gzipped := gziphandler.GzipHandler(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if policy, ok := h.requestPolicy(r); ok && policy.encrypt {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gzipped.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,131 @@
+package rproxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gobwas/glob"
+	"github.com/samber/lo"
+)
+
+// Values browsers send on the Sec-Fetch-Site header
+var fetchSites = []string{"same-origin", "same-site", "cross-site", "none"}
+
+func (rule *originRule) validate() error {
+	if err := rule.route.validate(); err != nil {
+		return err
+	}
+	for _, origin := range rule.AllowedOrigins {
+		if _, err := glob.Compile(origin); err != nil {
+			return fmt.Errorf("invalid origin pattern %q: %w", origin, err)
+		}
+	}
+	for _, site := range rule.AllowedFetchSites {
+		if !lo.Contains(fetchSites, site) {
+			return fmt.Errorf("unknown fetch site %q", site)
+		}
+	}
+	return nil
+}
+
+// compiledOriginRule is an origin rule ready to be matched, along with how many requests it has turned down since the
+// handler was created
+type compiledOriginRule struct {
+	originRule
+	matcher    *routeMatcher
+	origins    []glob.Glob
+	rejections uint64
+}
+
+func compileOriginRules(rules []originRule) ([]*compiledOriginRule, error) {
+	compiled := make([]*compiledOriginRule, 0, len(rules))
+	for i, rule := range rules {
+		matcher, err := newRouteMatcher(rule.route)
+		if err != nil {
+			return nil, err
+		}
+		cr := &compiledOriginRule{originRule: rule, matcher: matcher}
+		if cr.Name == "" {
+			cr.Name = fmt.Sprintf("originRules[%d]", i)
+		}
+		for _, origin := range rule.AllowedOrigins {
+			g, err := glob.Compile(origin)
+			if err != nil {
+				return nil, err
+			}
+			cr.origins = append(cr.origins, g)
+		}
+		compiled = append(compiled, cr)
+	}
+	return compiled, nil
+}
+
+// rejectionReason tells why the request doesn't satisfy the rule, or returns an empty string if it does
+func (rule *compiledOriginRule) rejectionReason(r *http.Request) string {
+	if site := r.Header.Get(hSecFetchSite); site != "" && len(rule.AllowedFetchSites) > 0 &&
+		!lo.Contains(rule.AllowedFetchSites, site) {
+		return fmt.Sprintf("Sec-Fetch-Site %q isn't allowed", site)
+	}
+	origin := requestOrigin(r)
+	if origin == "" {
+		return IfTrueElse(rule.AllowMissingOrigin, "", "missing Origin and Referer")
+	}
+	if len(rule.origins) > 0 && !lo.ContainsBy(rule.origins, func(g glob.Glob) bool { return g.Match(origin) }) {
+		return fmt.Sprintf("origin %q isn't allowed", origin)
+	}
+	return ""
+}
+
+// requestOrigin returns the origin of the page that made the request, taken from the Origin header or, when it's
+// missing, from the Referer header
+func requestOrigin(r *http.Request) string {
+	if origin := strings.TrimSpace(r.Header.Get(hOrigin)); origin != "" {
+		return origin
+	}
+	referer, err := url.Parse(strings.TrimSpace(r.Header.Get(hReferer)))
+	if err != nil || referer.Scheme == "" || referer.Host == "" {
+		return ""
+	}
+	return referer.Scheme + "://" + referer.Host
+}
+
+// withOriginRules is for turning down the requests that don't satisfy every origin rule matching their destination.
+// Unlike CORS, which is only honored by browsers, this applies to every client
+func (h *handler) withOriginRules(next http.Handler) http.Handler {
+	if len(h.originRules) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		destination, err := requestURIToProxyURL(r.RequestURI)
+		// Requests that can't be proxied are turned down by the handler itself
+		if destination == nil || err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, rule := range h.originRules {
+			if !rule.matcher.match(destination) {
+				continue
+			}
+			if reason := rule.rejectionReason(r); reason != "" {
+				atomic.AddUint64(&rule.rejections, 1)
+				w.WriteHeader(http.StatusForbidden)
+				log.Printf("Denying request from %s to Host: %q by the origin rule %q: %s", realIP(r), destination.Host, rule.Name, reason)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// originRejections returns how many requests each origin rule has turned down
+func (h *handler) originRejections() map[string]uint64 {
+	rejections := make(map[string]uint64, len(h.originRules))
+	for _, rule := range h.originRules {
+		rejections[rule.Name] += atomic.LoadUint64(&rule.rejections)
+	}
+	return rejections
+}
@@ -0,0 +1,59 @@
+package rproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginRules(t *testing.T) {
+	rules, err := compileOriginRules([]originRule{
+		{
+			route:             route{Host: "api.fundamentei.io"},
+			Name:              "app",
+			AllowedOrigins:    []string{"https://*.fundamentei.io", "https://fundamentei.io"},
+			AllowedFetchSites: []string{"same-site"},
+		},
+		{
+			route:              route{Host: "public.fundamentei.io"},
+			AllowMissingOrigin: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handler{originRules: rules}
+	handler := h.withOriginRules(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name        string
+		destination string
+		headers     map[string]string
+		statusCode  int
+	}{
+		{"allowed origin", "https://api.fundamentei.io/json", map[string]string{hOrigin: "https://app.fundamentei.io", hSecFetchSite: "same-site"}, http.StatusOK},
+		{"allowed referer", "https://api.fundamentei.io/json", map[string]string{hReferer: "https://fundamentei.io/some/page?q=1"}, http.StatusOK},
+		{"origin takes precedence", "https://api.fundamentei.io/json", map[string]string{hOrigin: "https://evil.com", hReferer: "https://fundamentei.io/"}, http.StatusForbidden},
+		{"disallowed fetch site", "https://api.fundamentei.io/json", map[string]string{hOrigin: "https://app.fundamentei.io", hSecFetchSite: "cross-site"}, http.StatusForbidden},
+		{"missing origin", "https://api.fundamentei.io/json", nil, http.StatusForbidden},
+		{"missing origin allowed", "https://public.fundamentei.io/json", nil, http.StatusOK},
+		{"unmatched destination", "https://httpbin.org/json", map[string]string{hOrigin: "https://evil.com"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/"+tt.destination, nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.statusCode {
+				t.Fatalf("expected %d, got %d", tt.statusCode, w.Code)
+			}
+		})
+	}
+
+	if rejections := h.originRejections(); rejections["app"] != 3 || rejections["originRules[1]"] != 0 {
+		t.Fatalf("unexpected rejection counters %v", rejections)
+	}
+}
@@ -0,0 +1,116 @@
+package rproxy
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/samber/lo"
+)
+
+// How many times paths are percent-decoded at most before matching them against the path rules
+const maxPathDecodings = 3
+
+// compiledPathRule is a path rule ready to be matched
+type compiledPathRule struct {
+	host    glob.Glob
+	paths   []glob.Glob
+	regexes []*regexp.Regexp
+	methods []string
+}
+
+func (rule *pathRule) validate() error {
+	_, err := compilePathRule(*rule)
+	return err
+}
+
+func compilePathRule(rule pathRule) (*compiledPathRule, error) {
+	host, err := glob.Compile(IfTrueElse(rule.Host == "", "*", rule.Host))
+	if err != nil {
+		return nil, fmt.Errorf("invalid host pattern %q: %w", rule.Host, err)
+	}
+	cr := &compiledPathRule{host: host, methods: rule.Methods}
+	for _, p := range rule.Paths {
+		g, err := glob.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q: %w", p, err)
+		}
+		cr.paths = append(cr.paths, g)
+	}
+	for _, expr := range rule.PathRegexes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path regex %q: %w", expr, err)
+		}
+		cr.regexes = append(cr.regexes, re)
+	}
+	if len(cr.paths) == 0 && len(cr.regexes) == 0 {
+		return nil, fmt.Errorf("either paths or pathRegexes is required")
+	}
+	return cr, nil
+}
+
+func compilePathRules(rules []pathRule) ([]*compiledPathRule, error) {
+	compiled := make([]*compiledPathRule, 0, len(rules))
+	for _, rule := range rules {
+		cr, err := compilePathRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, cr)
+	}
+	return compiled, nil
+}
+
+// match tells whether the request is covered by the rule, where the path is expected to be normalized already
+func (rule *compiledPathRule) match(method, host, path string) bool {
+	if !rule.host.Match(host) || (len(rule.methods) > 0 && !lo.Contains(rule.methods, method)) {
+		return false
+	}
+	return lo.ContainsBy(rule.paths, func(g glob.Glob) bool { return g.Match(path) }) ||
+		lo.ContainsBy(rule.regexes, func(re *regexp.Regexp) bool { return re.MatchString(path) })
+}
+
+// isPathAllowed is for checking the destination against the path rules. Requests matching any of the deny rules are
+// turned down, and so are the requests that don't match any of the allow rules covering the destination host
+func (h *handler) isPathAllowed(method string, destination *url.URL) bool {
+	p := normalizedPath(destination.Path)
+	if lo.ContainsBy(h.deniedPaths, func(rule *compiledPathRule) bool { return rule.match(method, destination.Host, p) }) {
+		return false
+	}
+	allowed := lo.Filter(h.allowedPaths, func(rule *compiledPathRule, _ int) bool {
+		return rule.host.Match(destination.Host)
+	})
+	return len(allowed) == 0 || lo.ContainsBy(allowed, func(rule *compiledPathRule) bool {
+		return rule.match(method, destination.Host, p)
+	})
+}
+
+// cleanPath is for resolving dot segments and collapsing repeated slashes, so there's a single way of writing each path
+// and what's matched against the rules is what the destination gets
+func cleanPath(p string) string {
+	if p == "" {
+		return ""
+	}
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// normalizedPath is for decoding the path until there's nothing left to decode before cleaning it, so the rules can't
+// be dodged by encoding the path more times than the destination decodes it, or with backslashes
+func normalizedPath(p string) string {
+	for i := 0; i < maxPathDecodings; i++ {
+		unescaped, err := url.PathUnescape(p)
+		if err != nil || unescaped == p {
+			break
+		}
+		p = unescaped
+	}
+	return IfTrueElse(p == "", "/", cleanPath(strings.ReplaceAll(p, `\`, "/")))
+}
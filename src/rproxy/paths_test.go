@@ -0,0 +1,118 @@
+package rproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizedPath(t *testing.T) {
+	tests := map[string]string{
+		"":                             "/",
+		"/":                            "/",
+		"/v1/json":                     "/v1/json",
+		"/v1/json/":                    "/v1/json/",
+		"//admin///users":              "/admin/users",
+		"/public/../admin":             "/admin",
+		"/public/%2e%2e/admin":         "/admin",
+		"/public/%252e%252e/%2561dmin": "/admin",
+		`/public\..\admin`:             "/admin",
+		"/public/%2F..%2Fadmin":        "/admin",
+	}
+	for p, want := range tests {
+		if got := normalizedPath(p); got != want {
+			t.Errorf("%q: expected %q, got %q", p, want, got)
+		}
+	}
+}
+
+func TestPathRules(t *testing.T) {
+	denied, err := compilePathRules([]pathRule{
+		{Paths: []string{"/admin", "/admin/*"}},
+		{Host: "api.fundamentei.io", PathRegexes: []string{`^/v[0-9]+/internal(/|$)`}},
+		{Host: "api.fundamentei.io", Paths: []string{"/v1/*"}, Methods: []string{http.MethodDelete}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, err := compilePathRules([]pathRule{
+		{Host: "cdn.fundamentei.io", Paths: []string{"/assets/*"}, Methods: []string{http.MethodGet}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handler{allowedPaths: allowed, deniedPaths: denied}
+
+	tests := []struct {
+		method     string
+		requestURI string
+		allowed    bool
+	}{
+		{http.MethodGet, "/https://api.fundamentei.io/v1/json", true},
+		{http.MethodGet, "/https://api.fundamentei.io/admin", false},
+		{http.MethodGet, "/https://api.fundamentei.io//admin/users", false},
+		{http.MethodGet, "/https://api.fundamentei.io/v1/../admin/", false},
+		{http.MethodGet, "/https%3A%2F%2Fapi.fundamentei.io%2Fv1%2F%252e%252e%2Fadmin", false},
+		{http.MethodGet, "/https://API.FUNDAMENTEI.IO/v2/internal/users", false},
+		{http.MethodGet, "/https://api.fundamentei.io/v2/internals", true},
+		{http.MethodDelete, "/https://api.fundamentei.io/v1/users/1", false},
+		{http.MethodGet, "/https://cdn.fundamentei.io/assets/logo.svg", true},
+		{http.MethodPost, "/https://cdn.fundamentei.io/assets/logo.svg", false},
+		{http.MethodGet, "/https://cdn.fundamentei.io/secrets.txt", false},
+		{http.MethodGet, "/https://cdn.fundamentei.io/assets/../secrets.txt", false},
+	}
+	for _, tt := range tests {
+		destination, err := requestURIToProxyURL(tt.requestURI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := h.isPathAllowed(tt.method, destination); got != tt.allowed {
+			t.Errorf("%s %s: expected allowed to be %v, got %v", tt.method, tt.requestURI, tt.allowed, got)
+		}
+	}
+}
+
+func TestForwardedPath(t *testing.T) {
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.RequestURI
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewHandler(&Config{
+		General: general{
+			AllowedHosts:         []string{"127.0.0.1:*"},
+			AllowedMethods:       []string{http.MethodGet},
+			IsEncryptedHeaderKey: "X-Is-Encrypted",
+		},
+		Limits:    limits{MaxRequestSizeInKB: 1024, MaxResponseSizeInKB: 1024},
+		PathRules: pathRules{Deny: []pathRule{{Paths: []string{"/admin", "/admin/*"}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		status   int
+		expected string
+	}{
+		{path: "", status: http.StatusOK, expected: "/"},
+		{path: "//v1///json", status: http.StatusOK, expected: "/v1/json"},
+		{path: "/public/%252e%252e/users", status: http.StatusOK, expected: "/users"},
+		{path: `/public/..%5Cusers`, status: http.StatusOK, expected: "/users"},
+		{path: "/v1/hello%2520world", status: http.StatusOK, expected: "/v1/hello%20world"},
+		{path: "/v1/json?page=2&q=a+b", status: http.StatusOK, expected: "/v1/json?page=2&q=a%20b"},
+		{path: "/public/%252e%252e/admin", status: http.StatusForbidden},
+		{path: `/public/..%5Cadmin`, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		received = ""
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+upstream.URL+tt.path, nil))
+		if w.Code != tt.status || received != tt.expected {
+			t.Errorf("%q: expected %d with %q forwarded, got %d with %q", tt.path, tt.status, tt.expected, w.Code, received)
+		}
+	}
+}
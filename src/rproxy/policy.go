@@ -0,0 +1,130 @@
+package rproxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// destinationPolicy is what applies to the requests to a destination, which are the general settings overridden by the
+// most specific policy matching the destination
+type destinationPolicy struct {
+	name                string
+	allowedMethods      []string
+	maxRequestSizeInKb  uint64
+	maxResponseSizeInKb uint64
+	timeout             time.Duration
+	encrypt             bool
+	requestHeaders      headerPolicy
+	responseHeaders     headerPolicy
+}
+
+type compiledPolicy struct {
+	policy
+	matcher *routeMatcher
+}
+
+func (p *policy) validate() error {
+	if err := p.route.validate(); err != nil {
+		return err
+	}
+	if err := p.RequestHeaders.validate(); err != nil {
+		return err
+	}
+	return p.ResponseHeaders.validate()
+}
+
+// compilePolicies is for sorting the policies from the most specific to the least specific one, keeping the order they
+// were declared in when they're as specific
+func compilePolicies(policies []policy) ([]compiledPolicy, error) {
+	compiled := make([]compiledPolicy, 0, len(policies))
+	for _, p := range policies {
+		matcher, err := newRouteMatcher(p.route)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, compiledPolicy{policy: p, matcher: matcher})
+	}
+	sort.SliceStable(compiled, func(i, j int) bool {
+		hostI, pathI := compiled[i].route.specificity()
+		hostJ, pathJ := compiled[j].route.specificity()
+		return hostI > hostJ || (hostI == hostJ && pathI > pathJ)
+	})
+	return compiled, nil
+}
+
+// withPolicy is for finding out once what applies to the destination of the request, so every middleware and the
+// handler go by the same policy, available through requestPolicy
+func (h *handler) withPolicy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if destination, err := requestURIToProxyURL(r.RequestURI); destination != nil && err == nil {
+			policy := h.policyFor(destination)
+			r = r.WithContext(context.WithValue(r.Context(), policyContextKey, &policy))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestPolicy returns the policy resolved by withPolicy, or false when the destination of the request is invalid
+func (h *handler) requestPolicy(r *http.Request) (destinationPolicy, bool) {
+	if policy, ok := r.Context().Value(policyContextKey).(*destinationPolicy); ok {
+		return *policy, true
+	}
+	if destination, err := requestURIToProxyURL(r.RequestURI); destination != nil && err == nil {
+		return h.policyFor(destination), true
+	}
+	return destinationPolicy{}, false
+}
+
+// policyFor returns what applies to the requests to the destination
+func (h *handler) policyFor(destination *url.URL) destinationPolicy {
+	dp := destinationPolicy{
+		allowedMethods:      h.allowedMethods,
+		maxRequestSizeInKb:  h.maxRequestSizeInKb,
+		maxResponseSizeInKb: h.maxResponseSizeInKb,
+		timeout:             h.timeout,
+		encrypt:             true,
+		requestHeaders:      headerPolicy{h.requestHeaders},
+		responseHeaders:     headerPolicy{h.responseHeaders},
+	}
+	for _, p := range h.policies {
+		if !p.matcher.match(destination) {
+			continue
+		}
+		dp.name = p.Name
+		if len(p.AllowedMethods) > 0 {
+			dp.allowedMethods = p.AllowedMethods
+		}
+		if p.MaxRequestSizeInKB != nil {
+			dp.maxRequestSizeInKb = *p.MaxRequestSizeInKB
+		}
+		if p.MaxResponseSizeInKB != nil {
+			dp.maxResponseSizeInKb = *p.MaxResponseSizeInKB
+		}
+		if p.Timeout != nil {
+			dp.timeout = seconds(*p.Timeout)
+		}
+		if p.Encrypt != nil {
+			dp.encrypt = *p.Encrypt
+		}
+		dp.requestHeaders = append(dp.requestHeaders, p.RequestHeaders)
+		dp.responseHeaders = append(dp.responseHeaders, p.ResponseHeaders)
+		break
+	}
+	return dp
+}
+
+// specificity is for ranking routes by how many literal characters their host and path globs have. Empty globs match
+// everything, so they're the least specific
+func (rt route) specificity() (int, int) {
+	literals := func(pattern string) int {
+		if pattern == "" {
+			return -1
+		}
+		return len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+	}
+	return literals(rt.Host), literals(rt.Path)
+}
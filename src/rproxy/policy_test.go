@@ -0,0 +1,134 @@
+package rproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPolicyFor(t *testing.T) {
+	disabled := false
+	small := uint64(1)
+	policies, err := compilePolicies([]policy{
+		{route: route{Host: "*.fundamentei.io"}, Name: "any subdomain", MaxResponseSizeInKB: &small},
+		{route: route{Host: "api.fundamentei.io"}, Name: "api", AllowedMethods: []string{http.MethodPut}},
+		{route: route{Host: "api.fundamentei.io", Path: "/assets/*"}, Name: "assets", Encrypt: &disabled},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handler{allowedMethods: []string{http.MethodGet}, maxResponseSizeInKb: 1024, policies: policies}
+
+	tests := []struct {
+		destination         string
+		name                string
+		method              string
+		maxResponseSizeInKb uint64
+		encrypt             bool
+	}{
+		{"https://api.fundamentei.io/assets/logo.svg", "assets", http.MethodGet, 1024, false},
+		{"https://api.fundamentei.io/json", "api", http.MethodPut, 1024, true},
+		{"https://www.fundamentei.io/", "any subdomain", http.MethodGet, 1, true},
+		{"https://httpbin.org/json", "", http.MethodGet, 1024, true},
+	}
+	for _, tt := range tests {
+		destination, _ := url.Parse(tt.destination)
+		p := h.policyFor(destination)
+		if p.name != tt.name || p.allowedMethods[0] != tt.method || p.maxResponseSizeInKb != tt.maxResponseSizeInKb || p.encrypt != tt.encrypt {
+			t.Errorf("%s: unexpected policy %+v", tt.destination, p)
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Cookie") != "" || r.Header.Get("X-Client") != "rproxy" {
+			t.Errorf("unexpected request headers: %v", r.Header)
+		}
+		w.Write([]byte("plaintext"))
+	}))
+	defer upstream.Close()
+
+	disabled := false
+	proxy, err := NewHandler(&Config{
+		General: general{
+			AllowedHosts:         []string{"127.0.0.1:*"},
+			AllowedMethods:       []string{http.MethodGet},
+			IsEncryptedHeaderKey: "X-Is-Encrypted",
+			SharedKey:            "shared",
+		},
+		Limits: limits{MaxRequestSizeInKB: 1024, MaxResponseSizeInKB: 1024},
+		Policies: []policy{
+			{
+				route:           route{Path: "/public/*"},
+				AllowedMethods:  []string{http.MethodGet, http.MethodPost},
+				Encrypt:         &disabled,
+				RequestHeaders:  headerRules{Set: map[string]string{"X-Client": "rproxy"}, Remove: []string{"Cookie"}},
+				ResponseHeaders: headerRules{Set: map[string]string{"Cache-Control": "public, max-age=60"}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/"+upstream.URL+"/public/asset", nil)
+	r.Header.Set("Cookie", "session=secret")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "plaintext" || w.Header().Get("X-Is-Encrypted") != "false" {
+		t.Fatalf("expected a plaintext response, got %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	if w.Header().Get("Cache-Control") != "public, max-age=60" {
+		t.Fatalf("expected the response headers to be set, got %v", w.Header())
+	}
+
+	// The general settings apply everywhere else
+	r = httptest.NewRequest(http.MethodPost, "/"+upstream.URL+"/private", nil)
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected the method not to be allowed, got %d", w.Code)
+	}
+}
+
+func TestRequestPolicy(t *testing.T) {
+	policies, err := compilePolicies([]policy{{route: route{Host: "api.fundamentei.io"}, Name: "api"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handler{allowedMethods: []string{http.MethodGet}, policies: policies}
+
+	for _, tt := range []struct {
+		requestURI string
+		name       string
+		ok         bool
+	}{
+		{requestURI: "/https://api.fundamentei.io/json", name: "api", ok: true},
+		{requestURI: "/https://httpbin.org/json", name: "", ok: true},
+		{requestURI: "/%zz", ok: false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RequestURI = tt.requestURI
+		h.withPolicy(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			stored, _ := r.Context().Value(policyContextKey).(*destinationPolicy)
+			if (stored != nil) != tt.ok {
+				t.Errorf("%s: expected the policy to be stored to be %v", tt.requestURI, tt.ok)
+			}
+			// Whatever is stored is what everyone goes by, without matching the policies again
+			if stored != nil {
+				stored.name = "stored"
+			}
+			p, ok := h.requestPolicy(r)
+			if ok != tt.ok || (ok && p.name != "stored") {
+				t.Errorf("%s: expected the stored policy, got %+v (%v)", tt.requestURI, p, ok)
+			}
+		})).ServeHTTP(httptest.NewRecorder(), r)
+
+		// Without the middleware the policy is matched on the spot
+		if p, ok := h.requestPolicy(r); ok != tt.ok || p.name != tt.name {
+			t.Errorf("%s: expected the %q policy, got %+v (%v)", tt.requestURI, tt.name, p, ok)
+		}
+	}
+}
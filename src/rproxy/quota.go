@@ -0,0 +1,257 @@
+package rproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// How often the usage is written to disk, when it has changed
+const quotaFlushInterval = 5 * time.Second
+
+func (q *quotas) validate() error {
+	if q.StoreFile == "" {
+		return errors.New("storeFile is required")
+	}
+	names := lo.Map(q.Tiers, func(tier quotaTier, _ int) string { return tier.Name })
+	if len(lo.Uniq(names)) != len(names) {
+		return errors.New("tier names must be unique")
+	}
+	if !lo.Contains(names, q.DefaultTier) {
+		return fmt.Errorf("unknown defaultTier %q", q.DefaultTier)
+	}
+	return nil
+}
+
+func (q *quotas) tier(name string) quotaTier {
+	if tier, ok := lo.Find(q.Tiers, func(tier quotaTier) bool { return tier.Name == name }); ok {
+		return tier
+	}
+	tier, _ := lo.Find(q.Tiers, func(tier quotaTier) bool { return tier.Name == q.DefaultTier })
+	return tier
+}
+
+// allowQuota is for checking whether the user still has quota left, counting the request in case it has. It writes
+// the response and returns false when the quota is exhausted
+func (h *handler) allowQuota(w http.ResponseWriter, r *http.Request) bool {
+	if h.quotas == nil {
+		return true
+	}
+	// Requests without verified credentials count towards the quota of the client IP, on the default tier
+	subject := verifiedSubject(r)
+	tier := h.quotas.tier(h.tierOf(r))
+	usage, allowed := h.quotaStore.take(subject, tier, time.Now())
+	if allowed {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(usage.resetsAt(tier)).Seconds())+1))
+	w.WriteHeader(http.StatusTooManyRequests)
+	log.Printf("Quota exhausted for %s on the %q tier", subject, tier.Name)
+	return false
+}
+
+// recordQuotaBytes is for adding the bytes sent back to the client to the usage of the user
+func (h *handler) recordQuotaBytes(r *http.Request, bytes int) {
+	if h.quotas != nil {
+		h.quotaStore.addBytes(verifiedSubject(r), int64(bytes), time.Now())
+	}
+}
+
+// quotaUsage is how much of the quota the user has used in the current day and month (UTC)
+type quotaUsage struct {
+	Day           string `json:"day"`
+	DayRequests   int64  `json:"dayRequests"`
+	DayBytes      int64  `json:"dayBytes"`
+	Month         string `json:"month"`
+	MonthRequests int64  `json:"monthRequests"`
+	MonthBytes    int64  `json:"monthBytes"`
+}
+
+// roll is for starting over the counters once the day or the month is over
+func (u *quotaUsage) roll(now time.Time) {
+	now = now.UTC()
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayRequests, u.DayBytes = day, 0, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthRequests, u.MonthBytes = month, 0, 0
+	}
+}
+
+// isExhausted tells whether any of the limits of the tier was reached. Limits set to zero are unlimited
+func (u *quotaUsage) isExhausted(tier quotaTier) bool {
+	reached := func(used, limit int64) bool { return limit > 0 && used >= limit }
+	return reached(u.DayRequests, tier.RequestsPerDay) || reached(u.MonthRequests, tier.RequestsPerMonth) ||
+		reached(u.DayBytes, tier.BytesPerDay) || reached(u.MonthBytes, tier.BytesPerMonth)
+}
+
+// resetsAt returns when the exhausted limits start over
+func (u *quotaUsage) resetsAt(tier quotaTier) time.Time {
+	day, _ := time.Parse("2006-01-02", u.Day)
+	reached := func(used, limit int64) bool { return limit > 0 && used >= limit }
+	if reached(u.MonthRequests, tier.RequestsPerMonth) || reached(u.MonthBytes, tier.BytesPerMonth) {
+		return time.Date(day.Year(), day.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return day.AddDate(0, 0, 1)
+}
+
+// fileQuotaStore keeps the usage in memory and persists it to a JSON file every once in a while, so it survives
+// restarts. Stores are shared by file, which keeps the usage when the handler is rebuilt on config reloads
+type fileQuotaStore struct {
+	path  string
+	mu    sync.Mutex
+	usage map[string]*quotaUsage
+	dirty bool
+	// Stops the periodic flushes once the store is closed
+	done chan struct{}
+}
+
+var (
+	quotaStoresMu sync.Mutex
+	quotaStores   = map[string]*fileQuotaStore{}
+)
+
+// openQuotaStore returns the store persisted to the given file, loading it if it hasn't been yet
+func openQuotaStore(path string) (*fileQuotaStore, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	quotaStoresMu.Lock()
+	defer quotaStoresMu.Unlock()
+	if store, ok := quotaStores[absPath]; ok {
+		return store, nil
+	}
+
+	store := &fileQuotaStore{path: absPath, usage: map[string]*quotaUsage{}, done: make(chan struct{})}
+	if data, err := os.ReadFile(absPath); err == nil {
+		if err := json.Unmarshal(data, &store.usage); err != nil {
+			return nil, fmt.Errorf("couldn't parse the quota store %q: %w", absPath, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	go store.flushPeriodically()
+	quotaStores[absPath] = store
+	return store, nil
+}
+
+// CloseQuotaStores is for persisting the usage kept by every quota store one last time and stopping their periodic
+// flushes, so no usage is lost when the process exits. It's meant to be called once the server is shut down
+func CloseQuotaStores() error {
+	quotaStoresMu.Lock()
+	defer quotaStoresMu.Unlock()
+	var errs []error
+	for path, store := range quotaStores {
+		close(store.done)
+		if err := store.flush(); err != nil {
+			errs = append(errs, fmt.Errorf("couldn't persist the quota store %q: %w", path, err))
+		}
+		delete(quotaStores, path)
+	}
+	return errors.Join(errs...)
+}
+
+func (s *fileQuotaStore) take(subject string, tier quotaTier, now time.Time) (quotaUsage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.get(subject, now)
+	if u.isExhausted(tier) {
+		return *u, false
+	}
+	u.DayRequests++
+	u.MonthRequests++
+	s.dirty = true
+	return *u, true
+}
+
+func (s *fileQuotaStore) addBytes(subject string, bytes int64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.get(subject, now)
+	u.DayBytes += bytes
+	u.MonthBytes += bytes
+	s.dirty = true
+}
+
+// get must be called with the lock held
+func (s *fileQuotaStore) get(subject string, now time.Time) *quotaUsage {
+	u, ok := s.usage[subject]
+	if !ok {
+		u = &quotaUsage{}
+		s.usage[subject] = u
+	}
+	u.roll(now)
+	return u
+}
+
+// snapshot returns a copy of the usage of everyone, or of a single subject when it's given
+func (s *fileQuotaStore) snapshot(subject string) map[string]quotaUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := map[string]quotaUsage{}
+	for k, u := range s.usage {
+		if subject == "" || subject == k {
+			u.roll(time.Now())
+			usage[k] = *u
+		}
+	}
+	return usage
+}
+
+// reset drops the usage of the subject, returning whether there was any
+func (s *fileQuotaStore) reset(subject string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.usage[subject]
+	delete(s.usage, subject)
+	s.dirty = true
+	return ok
+}
+
+func (s *fileQuotaStore) flushPeriodically() {
+	ticker := time.NewTicker(quotaFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				log.Printf("Couldn't persist the quota store %q: %v", s.path, err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// flush writes the usage to a temporary file that then replaces the store file, so it's never left half-written
+func (s *fileQuotaStore) flush() error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.usage)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,112 @@
+package rproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileQuotaStore(t *testing.T) {
+	store, err := openQuotaStore(filepath.Join(t.TempDir(), "quotas.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseQuotaStores()
+	tier := quotaTier{Name: "free", RequestsPerDay: 2, BytesPerMonth: 100}
+	now := time.Date(2022, time.October, 31, 23, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		if _, allowed := store.take("user", tier, now); !allowed {
+			t.Fatalf("request %d: expected to be allowed", i)
+		}
+	}
+	if usage, allowed := store.take("user", tier, now); allowed || !usage.resetsAt(tier).Equal(now.Add(time.Hour)) {
+		t.Fatalf("expected the daily quota to be exhausted until the next day, got %+v", usage)
+	}
+
+	// A new day starts over the daily counters, but the monthly ones only start over with the month
+	now = now.Add(time.Hour)
+	store.addBytes("user", 100, now)
+	if usage, allowed := store.take("user", tier, now); allowed || usage.DayRequests != 0 || usage.MonthBytes != 100 {
+		t.Fatalf("expected the monthly quota to be exhausted, got %+v", usage)
+	}
+	if _, allowed := store.take("user", tier, now.AddDate(0, 1, 0)); !allowed {
+		t.Fatal("expected the quota to start over on the next month")
+	}
+
+	if !store.reset("user") || len(store.snapshot("")) != 0 {
+		t.Fatal("expected the usage to be reset")
+	}
+}
+
+func TestCloseQuotaStores(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	store, err := openQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.take("user", quotaTier{Name: "free"}, time.Now())
+	if err := CloseQuotaStores(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the usage to be persisted on close: %v", err)
+	}
+
+	// Opening the store again loads what was persisted
+	store, err = openQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseQuotaStores()
+	if usage := store.snapshot("user"); usage["user"].DayRequests != 1 {
+		t.Fatalf("expected the usage to survive, got %+v", usage)
+	}
+}
+
+func TestAllowQuota(t *testing.T) {
+	store, err := openQuotaStore(filepath.Join(t.TempDir(), "quotas.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseQuotaStores()
+	h := &handler{
+		quotas: &quotas{
+			DefaultTier: "free",
+			Tiers:       []quotaTier{{Name: "free", RequestsPerDay: 1}, {Name: "pro", RequestsPerDay: 2}},
+		},
+		quotaStore: store,
+	}
+	request := func(id *identity) int {
+		r := httptest.NewRequest(http.MethodGet, "/https://api.fundamentei.io/v1/json", nil)
+		ctx := context.WithValue(r.Context(), realIPContextKey, "192.0.2.1")
+		r = r.WithContext(context.WithValue(ctx, identityContextKey, id))
+		w := httptest.NewRecorder()
+		if !h.allowQuota(w, r) {
+			return w.Code
+		}
+		return http.StatusOK
+	}
+
+	// Users get the quota of their tier
+	pro := &identity{subject: "jwt:user-1", verified: true, tier: "pro"}
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if code := request(pro); code != expected {
+			t.Fatalf("request %d: expected %d, got %d", i, expected, code)
+		}
+	}
+	// Unverified credentials share the quota of the client IP on the default tier, however often they change
+	if code := request(&identity{subject: hashedSubject("authorization", "a")}); code != http.StatusOK {
+		t.Fatalf("expected the first unverified request to be allowed, got %d", code)
+	}
+	if code := request(&identity{subject: hashedSubject("authorization", "b")}); code != http.StatusTooManyRequests {
+		t.Fatalf("expected rotated credentials to share the quota, got %d", code)
+	}
+	if code := request(&identity{}); code != http.StatusTooManyRequests {
+		t.Fatalf("expected anonymous requests to share the quota, got %d", code)
+	}
+}
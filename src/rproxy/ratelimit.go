@@ -0,0 +1,194 @@
+package rproxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// What requests are rate limited by
+const (
+	rateLimitByIP            = "ip"
+	rateLimitByAuthorization = "authorization"
+	rateLimitByAPIKey        = "apiKey"
+)
+
+// RateLimitStore keeps the token buckets used for rate limiting. The in-memory store is used by default, but stores
+// shared among multiple instances of the proxy can be plugged in through WithRateLimitStore
+type RateLimitStore interface {
+	// Take tries to take a token from the bucket identified by the key, which holds up to burst tokens and is refilled
+	// at rate tokens per second
+	Take(key string, rate float64, burst int) (RateLimitResult, error)
+}
+
+// RateLimitResult tells whether a token was taken from the bucket and what its state is after that
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// Time until a token is available again, only meaningful when the request isn't allowed
+	RetryAfter time.Duration
+	// Time until the bucket is full again
+	Reset time.Duration
+}
+
+type compiledRateLimit struct {
+	rateLimit
+	matcher *routeMatcher
+}
+
+func (rl *rateLimit) validate() error {
+	if rl.Name == "" {
+		return errors.New("name is required")
+	}
+	if err := rl.route.validate(); err != nil {
+		return err
+	}
+	if !lo.Contains([]string{"", rateLimitByIP, rateLimitByAuthorization, rateLimitByAPIKey}, rl.Key) {
+		return fmt.Errorf("unknown key %q", rl.Key)
+	}
+	if rl.RequestsPerSecond <= 0 || rl.Burst < 1 {
+		return fmt.Errorf("requestsPerSecond and burst must be positive")
+	}
+	return nil
+}
+
+func compileRateLimits(rateLimits []rateLimit) ([]compiledRateLimit, error) {
+	compiled := make([]compiledRateLimit, 0, len(rateLimits))
+	for _, rl := range rateLimits {
+		matcher, err := newRouteMatcher(rl.route)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, compiledRateLimit{rateLimit: rl, matcher: matcher})
+	}
+	return compiled, nil
+}
+
+// allowRate is for applying all the rate limits matching the destination. It writes the response and returns false if
+// the request went over any of them
+func (h *handler) allowRate(w http.ResponseWriter, r *http.Request, destination *url.URL) bool {
+	var tightest *RateLimitResult
+	var tightestLimit int
+	for _, rl := range h.rateLimits {
+		if !rl.matcher.match(destination) || (len(rl.Tiers) > 0 && !lo.Contains(rl.Tiers, h.tierOf(r))) {
+			continue
+		}
+		// Buckets are keyed by the name of the limit, so they're kept when the limits are added or reordered on a reload
+		key := rl.Name + ":" + rateLimitKey(r, rl.Key)
+		res, err := h.rateLimitStore.Take(key, rl.RequestsPerSecond, rl.Burst)
+		if err != nil {
+			// Not being able to reach the store shouldn't take the proxy down with it
+			log.Printf("Couldn't apply the rate limit %q: %v", rl.Name, err)
+			continue
+		}
+		if tightest == nil || !res.Allowed || res.Remaining < tightest.Remaining {
+			tightest, tightestLimit = &res, rl.Burst
+		}
+		if !res.Allowed {
+			break
+		}
+	}
+	if tightest == nil {
+		return true
+	}
+
+	// https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(tightestLimit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(tightest.Reset.Seconds()))))
+	if tightest.Allowed {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(tightest.RetryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	log.Printf("Rate limiting request from %s to Host: %q", realIP(r), destination.Host)
+	return false
+}
+
+// rateLimitKey identifies who's making the request, falling back to the client IP when the request lacks verified
+// credentials to be identified by
+func rateLimitKey(r *http.Request, by string) string {
+	switch by {
+	case rateLimitByAuthorization:
+		// When tokens are verified that's the subject of the token, so renewing it doesn't start over the limits
+		return verifiedSubject(r)
+	case rateLimitByAPIKey:
+		// Known keys are limited by their owner, so all the keys of the owner share the limits
+		if id := requestIdentity(r); id.apiKey != nil {
+			return id.subject
+		}
+	}
+	return "ip:" + realIP(r)
+}
+
+// memoryRateLimitStore keeps the token buckets in memory, so the limits are per instance of the proxy
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	// Time it takes to be full again, after which the bucket can be forgotten
+	fullAt time.Time
+}
+
+// How often buckets that are full again are dropped from memory
+const rateLimitSweepInterval = time.Minute
+
+// NewMemoryRateLimitStore is for creating a store that keeps the token buckets in memory
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*tokenBucket{}, now: time.Now}
+}
+
+func (s *memoryRateLimitStore) Take(key string, rate float64, burst int) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), updatedAt: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.updatedAt).Seconds()*rate)
+	b.updatedAt = now
+
+	res := RateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second))
+	b.fullAt = now.Add(res.Reset)
+	return res, nil
+}
+
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if !now.Before(b.fullAt) {
+			delete(s.buckets, key)
+		}
+	}
+}
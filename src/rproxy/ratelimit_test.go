@@ -0,0 +1,98 @@
+package rproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	now := time.Unix(0, 0)
+	store := NewMemoryRateLimitStore().(*memoryRateLimitStore)
+	store.now = func() time.Time { return now }
+
+	// The bucket starts full, so the burst goes through right away
+	for i := 0; i < 3; i++ {
+		if res, _ := store.Take("key", 1, 3); !res.Allowed || res.Remaining != 2-i {
+			t.Fatalf("request %d: unexpected result %+v", i, res)
+		}
+	}
+	res, _ := store.Take("key", 1, 3)
+	if res.Allowed || res.RetryAfter != time.Second || res.Reset != 3*time.Second {
+		t.Fatalf("expected to be limited, got %+v", res)
+	}
+	// Other keys have their own buckets
+	if res, _ := store.Take("another-key", 1, 3); !res.Allowed {
+		t.Fatalf("expected another key to be allowed, got %+v", res)
+	}
+
+	now = now.Add(1500 * time.Millisecond)
+	if res, _ := store.Take("key", 1, 3); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("expected a token to be refilled, got %+v", res)
+	}
+
+	// Buckets that are full again are forgotten
+	now = now.Add(time.Hour)
+	store.Take("key", 1, 3)
+	if len(store.buckets) != 1 {
+		t.Fatalf("expected stale buckets to be swept, got %d buckets", len(store.buckets))
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	apiKeys, err := compileAPIKeys([]apiKey{{Owner: "partner", KeyHash: HashAPIKey("partner-key")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutJWT := &handler{}
+	withAPIKeys := &handler{apiKeys: apiKeys}
+
+	tests := []struct {
+		name     string
+		h        *handler
+		by       string
+		header   string
+		value    string
+		expected string
+	}{
+		{"ip", withoutJWT, rateLimitByIP, hAuthorization, "token", "ip:192.0.2.1"},
+		// Unverified tokens could be rotated on every request to get a fresh allowance
+		{"unverified token", withoutJWT, rateLimitByAuthorization, hAuthorization, "token", "ip:192.0.2.1"},
+		{"another unverified token", withoutJWT, rateLimitByAuthorization, hAuthorization, "another-token", "ip:192.0.2.1"},
+		{"unverified API key", withoutJWT, rateLimitByAPIKey, hXAPIKey, "made-up-key", "ip:192.0.2.1"},
+		{"known API key", withAPIKeys, rateLimitByAPIKey, hXAPIKey, "partner-key", "apiKey:partner"},
+		{"known API key by authorization", withAPIKeys, rateLimitByAuthorization, hXAPIKey, "partner-key", "apiKey:partner"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/https://api.fundamentei.io/v1/json", nil)
+			r.Header.Set(tt.header, tt.value)
+			ctx := context.WithValue(r.Context(), realIPContextKey, "192.0.2.1")
+			r = r.WithContext(context.WithValue(ctx, identityContextKey, tt.h.authenticate(r)))
+			if key := rateLimitKey(r, tt.by); key != tt.expected {
+				t.Fatalf("expected %q, got %q", tt.expected, key)
+			}
+		})
+	}
+}
+
+func TestRateLimitNames(t *testing.T) {
+	for _, tc := range []struct {
+		names []string
+		valid bool
+	}{
+		{names: []string{"api", "assets"}, valid: true},
+		{names: []string{"api", ""}},
+		{names: []string{"api", "api"}},
+	} {
+		cfg := &Config{General: general{IsEncryptedHeaderKey: "X-Is-Encrypted"}}
+		for _, name := range tc.names {
+			cfg.RateLimits = append(cfg.RateLimits, rateLimit{Name: name, RequestsPerSecond: 1, Burst: 1})
+		}
+		if err := cfg.Validate(); (err == nil) != tc.valid {
+			t.Errorf("%q: expected valid to be %v, got %v", tc.names, tc.valid, err)
+		}
+	}
+}
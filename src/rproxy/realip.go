@@ -0,0 +1,177 @@
+package rproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/awslabs/aws-lambda-go-api-proxy/core"
+)
+
+type contextKey int
+
+const (
+	realIPContextKey contextKey = iota
+	identityContextKey
+	policyContextKey
+)
+
+// Headers the client IP can be read from, as written by the trusted proxies
+var clientIPHeaders = []string{hXForwardedFor, hForwarded, hXRealIP}
+
+// ipResolver is for finding out the IP of the client that originated the request. The peer connecting to us is only
+// taken as the client if it isn't a trusted proxy, otherwise the header written by the trusted proxies is walked from
+// right to left (from the closest hop to the furthest one) until an address that isn't trusted shows up
+type ipResolver struct {
+	trustedProxies []*net.IPNet
+	// Header the trusted proxies write the client IP to. Defaults to X-Forwarded-For
+	header string
+}
+
+// newIPResolver is for creating a resolver that reads the client IP from the given header when the peer is trusted
+func newIPResolver(trustedProxies []*net.IPNet, header string) *ipResolver {
+	if header == "" {
+		header = hXForwardedFor
+	}
+	return &ipResolver{trustedProxies: trustedProxies, header: http.CanonicalHeaderKey(header)}
+}
+
+// parseTrustedProxies is for parsing a list of CIDRs, where single IPs are also accepted
+func parseTrustedProxies(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", value)
+			}
+			bits := IfTrueElse(ip.To4() != nil, 32, 128)
+			value = fmt.Sprintf("%s/%d", value, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func (res *ipResolver) isTrusted(ip net.IP) bool {
+	for _, ipNet := range res.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPeerTrusted tells whether the forwarding headers that came with the request can be relied on. Unknown peers happen
+// when there's no connection, like when running behind an ALB on AWS Lambda, and are only trusted when trusted proxies
+// are configured, since otherwise nothing tells the headers were set by a load balancer rather than the client
+func (res *ipResolver) isPeerTrusted(r *http.Request) bool {
+	if peer := peerIP(r); peer != nil {
+		return res.isTrusted(peer)
+	}
+	return len(res.trustedProxies) > 0
+}
+
+// resolve returns the client IP, or an empty string if it couldn't be found
+func (res *ipResolver) resolve(r *http.Request) string {
+	peer := peerIP(r)
+	if !res.isPeerTrusted(r) {
+		if peer != nil {
+			return peer.String()
+		}
+		return ""
+	}
+
+	hops := forwardedFor(r.Header, IfTrueElse(res.header != "", res.header, hXForwardedFor))
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseIP(hops[i])
+		// Anything that comes before a malformed entry can't be relied on
+		if ip == nil {
+			break
+		}
+		if !res.isTrusted(ip) || i == 0 {
+			return ip.String()
+		}
+	}
+	if peer != nil {
+		return peer.String()
+	}
+	return ""
+}
+
+// peerIP returns the IP of whoever connected to us. On AWS Lambda behind API Gateway that's the source IP from the
+// request context
+func peerIP(r *http.Request) net.IP {
+	if ctx, ok := core.GetAPIGatewayContextFromContext(r.Context()); ok && ctx.Identity.SourceIP != "" {
+		return parseIP(ctx.Identity.SourceIP)
+	}
+	if ctx, ok := core.GetAPIGatewayV2ContextFromContext(r.Context()); ok && ctx.HTTP.SourceIP != "" {
+		return parseIP(ctx.HTTP.SourceIP)
+	}
+	return parseIP(r.RemoteAddr)
+}
+
+// forwardedFor returns the addresses the request was forwarded for according to the given header, ordered from the
+// furthest hop to the closest one. Other headers are ignored, since proxies pass them through as they came
+func forwardedFor(header http.Header, name string) []string {
+	var hops []string
+	if name != hForwarded {
+		for _, value := range header.Values(name) {
+			for _, hop := range strings.Split(value, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+		return hops
+	}
+	for _, value := range header.Values(hForwarded) {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hops = append(hops, strings.Trim(v, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseIP is for parsing IPs that may come with a port and/or within brackets, e.g. "[2001:db8::1]:4711"
+func parseIP(value string) net.IP {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	// Zones aren't meaningful outside of the host, e.g. "fe80::1%en0"
+	if i := strings.IndexByte(value, '%'); i >= 0 {
+		value = value[:i]
+	}
+	return net.ParseIP(value)
+}
+
+// withRealIP is for resolving the client IP once, before anything else, so it's available through realIP
+func withRealIP(res *ipResolver) middlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), realIPContextKey, res.resolve(r))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// realIP returns the client IP resolved by withRealIP
+func realIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(realIPContextKey).(string); ok {
+		return ip
+	}
+	return (&ipResolver{}).resolve(r)
+}
@@ -0,0 +1,108 @@
+package rproxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIPResolver(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::/32", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		// Header the client IP is read from, X-Forwarded-For when empty
+		clientIPHeader string
+		// Whether trusted proxies are configured at all
+		untrusting bool
+		header     http.Header
+		expected   string
+	}{
+		{
+			name:       "untrusted peer ignores forwarding headers",
+			remoteAddr: "203.0.113.9:4711",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.7"}},
+			expected:   "203.0.113.9",
+		},
+		{
+			name:       "untrusted IPv6 peer",
+			remoteAddr: "[2001:db9::1]:4711",
+			expected:   "2001:db9::1",
+		},
+		{
+			name:       "trusted peer walks X-Forwarded-For from right to left",
+			remoteAddr: "10.0.0.1:4711",
+			header:     http.Header{"X-Forwarded-For": {"192.0.2.1, 198.51.100.7", "10.1.1.1"}},
+			expected:   "198.51.100.7",
+		},
+		{
+			name:       "all hops trusted falls back to the furthest one",
+			remoteAddr: "10.0.0.1:4711",
+			header:     http.Header{"X-Forwarded-For": {"10.2.2.2, 10.1.1.1"}},
+			expected:   "10.2.2.2",
+		},
+		{
+			name:       "malformed hops stop the walk",
+			remoteAddr: "10.0.0.1:4711",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.7, garbage, 10.1.1.1"}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "spoofed Forwarded is ignored when reading X-Forwarded-For",
+			remoteAddr: "[2001:db8::1]:4711",
+			header: http.Header{
+				"Forwarded":       {`for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`},
+				"X-Forwarded-For": {"198.51.100.7"},
+			},
+			expected: "198.51.100.7",
+		},
+		{
+			name:           "Forwarded when configured",
+			remoteAddr:     "[2001:db8::1]:4711",
+			clientIPHeader: "forwarded",
+			header: http.Header{
+				"Forwarded":       {`for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`},
+				"X-Forwarded-For": {"198.51.100.7"},
+			},
+			expected: "192.0.2.60",
+		},
+		{
+			name:       "X-Real-Ip is ignored unless configured",
+			remoteAddr: "127.0.0.1:4711",
+			header:     http.Header{"X-Real-Ip": {"198.51.100.7"}},
+			expected:   "127.0.0.1",
+		},
+		{
+			name:           "trusted peer with X-Real-Ip",
+			remoteAddr:     "127.0.0.1:4711",
+			clientIPHeader: "X-Real-Ip",
+			header:         http.Header{"X-Real-Ip": {"198.51.100.7"}, "X-Forwarded-For": {"192.0.2.60"}},
+			expected:       "198.51.100.7",
+		},
+		{
+			name:     "unknown peer relies on forwarding headers when trusted proxies are configured",
+			header:   http.Header{"X-Forwarded-For": {"192.0.2.60, 198.51.100.7"}},
+			expected: "198.51.100.7",
+		},
+		{
+			name:       "unknown peer without trusted proxies ignores forwarding headers",
+			untrusting: true,
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.7"}, "Forwarded": {"for=192.0.2.60"}},
+			expected:   "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			if tc.header != nil {
+				r.Header = tc.header
+			}
+			res := newIPResolver(IfTrueElse(tc.untrusting, nil, trustedProxies), tc.clientIPHeader)
+			if ip := res.resolve(r); ip != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, ip)
+			}
+		})
+	}
+}
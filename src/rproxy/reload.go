@@ -0,0 +1,248 @@
+package rproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// Config paths (or the sections they're in) whose values are harmless enough to end up in the logs when summarizing
+// what changed in a reload. Anything else may hold secrets, such as credentials set on the upstream requests, so only
+// the fact that it changed is logged
+var publicConfigPaths = []string{
+	"general.sharedKeyOriginHeader",
+	"general.isEncryptedHeaderKey",
+	"general.allowedHosts",
+	"general.disallowedHosts",
+	"general.allowedMethods",
+	"general.trustedProxies",
+	"general.clientIPHeader",
+	"general.unsafeCORS",
+	"general.listen",
+	"general.lambdaEventFormat",
+	"general.readinessPath",
+	"general.watchConfig",
+	"limits",
+	"timeouts",
+	"cors",
+	"forwarding",
+	"compression",
+	"tls.minVersion",
+	"tls.cipherSuites",
+	"tls.clientAuth",
+	"tls.redirectListen",
+	"tls.watchCertificates",
+	"jwt.algorithms",
+	"jwt.issuer",
+	"jwt.audience",
+	"jwt.leeway",
+	"jwt.allowAnonymous",
+	"quotas.defaultTier",
+}
+
+// Config paths that are only read once when the process starts, so changing them requires a restart
+var restartOnlyConfigPaths = []string{
+	"general.lambdaEventFormat",
+	"general.listen",
+	"general.readinessPath",
+	"general.watchConfig",
+	"timeouts.readHeaderTimeout",
+	"timeouts.readTimeout",
+	"timeouts.writeTimeout",
+	"timeouts.idleTimeout",
+	"timeouts.shutdownDrainPeriod",
+	"timeouts.shutdownTimeout",
+	"tls",
+}
+
+// ReloadableHandler is a handler that can have its configuration reloaded at runtime without dropping connections.
+// Requests that are already in-flight keep being served by the handler they started with, while new ones are picked up
+// by the most recently built one
+type ReloadableHandler struct {
+	filepath string
+	// Applied to every handler that's built, so what they hold outlives the reloads
+	opts []HandlerOption
+	// Makes sure that only one reload happens at a time
+	mu sync.Mutex
+	// Holds the current `*reloadableState`
+	state atomic.Value
+}
+
+type reloadableState struct {
+	cfg     *Config
+	handler http.Handler
+}
+
+// NewReloadableHandler is for creating a handler out of an already validated config that can later be reloaded from
+// the file it was loaded from. The rate limits are kept in memory unless another store is given through the options,
+// and either way the same store is used across reloads, so reloading doesn't give anyone a fresh allowance
+func NewReloadableHandler(filepath string, cfg *Config, opts ...HandlerOption) (*ReloadableHandler, error) {
+	opts = append([]HandlerOption{WithRateLimitStore(NewMemoryRateLimitStore())}, opts...)
+	handler, err := NewHandler(cfg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	rh := &ReloadableHandler{filepath: filepath, opts: opts}
+	rh.state.Store(&reloadableState{cfg: cfg, handler: handler})
+	return rh, nil
+}
+
+func (rh *ReloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rh.current().handler.ServeHTTP(w, r)
+}
+
+// Config returns the configuration currently in use
+func (rh *ReloadableHandler) Config() *Config {
+	return rh.current().cfg
+}
+
+// Reload reads the config file again and swaps the underlying handler. If the new config can't be loaded or doesn't
+// pass validation, the previous one is kept and the error is returned
+func (rh *ReloadableHandler) Reload() error {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	cfg, err := NewConfigFromFile(rh.filepath)
+	if err != nil {
+		return fmt.Errorf("couldn't load %q, keeping the previous config: %w", rh.filepath, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config %q, keeping the previous config: %w", rh.filepath, err)
+	}
+
+	prev := rh.current()
+	changes := diffConfigs(prev.cfg, cfg)
+	if len(changes) == 0 {
+		log.Printf("Reloaded %q, nothing has changed", rh.filepath)
+		return nil
+	}
+
+	handler, err := NewHandler(cfg, rh.opts...)
+	if err != nil {
+		return fmt.Errorf("couldn't build a handler out of %q, keeping the previous config: %w", rh.filepath, err)
+	}
+	rh.state.Store(&reloadableState{cfg: cfg, handler: handler})
+	log.Printf("Reloaded %q with %d change(s):", rh.filepath, len(changes))
+	for _, change := range changes {
+		log.Printf("\t%s", change)
+	}
+	return nil
+}
+
+// WatchFile polls the config file for changes every interval and reloads it whenever it changes. It blocks until the
+// context is done
+func (rh *ReloadableHandler) WatchFile(ctx context.Context, interval time.Duration) {
+	watchFiles(ctx, interval, []string{rh.filepath}, func() {
+		if err := rh.Reload(); err != nil {
+			log.Print(err)
+		}
+	})
+}
+
+func (rh *ReloadableHandler) current() *reloadableState {
+	return rh.state.Load().(*reloadableState)
+}
+
+// diffConfigs is for summarizing what changed between two configs. Each entry is formatted as "path: before -> after"
+// where the path is made out of the TOML keys, or as "path: changed" unless the path is known to be public
+func diffConfigs(prev, next *Config) []string {
+	var changes []string
+	diffValues("", reflect.ValueOf(prev).Elem(), reflect.ValueOf(next).Elem(), &changes)
+	return changes
+}
+
+func diffValues(path string, prev, next reflect.Value, changes *[]string) {
+	switch prev.Kind() {
+	case reflect.Ptr:
+		if prev.IsNil() || next.IsNil() {
+			if prev.IsNil() != next.IsNil() {
+				*changes = append(*changes, fmt.Sprintf("%s: %s", path, IfTrueElse(prev.IsNil(), "added", "removed")))
+			}
+			return
+		}
+		diffValues(path, prev.Elem(), next.Elem(), changes)
+	case reflect.Struct:
+		for i := 0; i < prev.NumField(); i++ {
+			field := prev.Type().Field(i)
+			name := strings.Split(field.Tag.Get("toml"), ",")[0]
+			if name == "" {
+				name = field.Name
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			diffValues(name, prev.Field(i), next.Field(i), changes)
+		}
+	default:
+		if reflect.DeepEqual(prev.Interface(), next.Interface()) {
+			return
+		}
+		change := fmt.Sprintf("%s: changed", path)
+		if isConfigPathIn(publicConfigPaths, path) && !holdsStructs(prev.Type()) {
+			change = fmt.Sprintf("%s: %v -> %v", path, prev.Interface(), next.Interface())
+		}
+		if isConfigPathIn(restartOnlyConfigPaths, path) {
+			change += " (requires a restart to take effect)"
+		}
+		*changes = append(*changes, change)
+	}
+}
+
+// isConfigPathIn tells whether the path is one of the given ones, or is within one of them
+func isConfigPathIn(paths []string, path string) bool {
+	return lo.ContainsBy(paths, func(p string) bool { return path == p || strings.HasPrefix(path, p+".") })
+}
+
+// holdsStructs tells whether the type is a slice or map of structs, which are too large to be logged as is
+func holdsStructs(t reflect.Type) bool {
+	if t.Kind() != reflect.Slice && t.Kind() != reflect.Map {
+		return false
+	}
+	elem := t.Elem()
+	if elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	return elem.Kind() == reflect.Struct
+}
+
+// watchFiles polls the files every interval and calls onChange whenever the modification time or size of any of them
+// changes. It blocks until the context is done
+func watchFiles(ctx context.Context, interval time.Duration, paths []string, onChange func()) {
+	stat := func() []string {
+		return lo.Map(paths, func(path string, _ int) string {
+			info, err := os.Stat(path)
+			if err != nil {
+				log.Printf("Couldn't stat %q while watching for changes: %v", path, err)
+				return ""
+			}
+			return fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size())
+		})
+	}
+
+	last := stat()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := stat()
+			// Files that can't be read are left for the next tick, they may be in the middle of being replaced
+			if lo.Contains(current, "") || reflect.DeepEqual(current, last) {
+				continue
+			}
+			last = current
+			onChange()
+		}
+	}
+}
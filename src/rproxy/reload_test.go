@@ -0,0 +1,105 @@
+package rproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	prev := &Config{General: general{SharedKey: "a", AllowedHosts: []string{"*.fundamentei.io"}}}
+	next := &Config{
+		General: general{SharedKey: "b", AllowedHosts: []string{"*.fundamentei.io", "httpbin.org"}},
+		Limits:  limits{MaxRequestSizeInKB: 10},
+		CORS:    &corsOptions{},
+		Headers: headers{Request: headerRules{Set: map[string]string{"Authorization": "Bearer upstream"}}},
+		APIKeys: []apiKey{{Owner: "someone", KeyHash: "abc"}},
+	}
+
+	changes := diffConfigs(prev, next)
+	expected := []string{
+		"general.sharedKey: changed",
+		"general.allowedHosts: [*.fundamentei.io] -> [*.fundamentei.io httpbin.org]",
+		"limits.maxRequestSizeInKb: 0 -> 10",
+		"cors: added",
+		"headers.request.set: changed",
+		"apiKeys: changed",
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("unexpected diff: %q", changes)
+	}
+	if changes := diffConfigs(next, next); len(changes) != 0 {
+		t.Fatalf("expected no changes, got: %q", changes)
+	}
+}
+
+func TestReloadKeepsRateLimits(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	cfgPath := filepath.Join(t.TempDir(), "config.toml")
+	// Limits added before the existing ones shouldn't start the buckets over either
+	writeConfig := func(sharedKey, rateLimits string) {
+		contents := `
+[general]
+allowedHosts = ["127.0.0.1:*"]
+allowedMethods = ["GET"]
+isEncryptedHeaderKey = "X-Is-Encrypted"
+sharedKey = "` + sharedKey + `"
+
+[limits]
+maxRequestSizeInKb = 10
+maxResponseSizeInKb = 10
+` + rateLimits + `
+[[rateLimits]]
+name = "everything"
+requestsPerSecond = 0.001
+burst = 1
+`
+		if err := os.WriteFile(cfgPath, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("a", "")
+	cfg, err := NewConfigFromFile(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rh, err := NewReloadableHandler(cfgPath, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func() int {
+		w := httptest.NewRecorder()
+		rh.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/json", nil))
+		return w.Code
+	}
+	if code := request(); code != http.StatusOK {
+		t.Fatalf("expected the first request to go through, got %d", code)
+	}
+	if code := request(); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the second request to be limited, got %d", code)
+	}
+
+	writeConfig("b", `
+[[rateLimits]]
+name = "generous"
+requestsPerSecond = 1000
+burst = 1000
+`)
+	if err := rh.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if rh.Config().General.SharedKey != "b" {
+		t.Fatal("expected the config to be reloaded")
+	}
+	if code := request(); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the limit to outlive the reload, got %d", code)
+	}
+}
@@ -0,0 +1,43 @@
+package rproxy
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/gobwas/glob"
+)
+
+// route selects requests based on the destination they're being proxied to. Rules that apply only to some of the
+// destinations embed it
+type route struct {
+	// Glob matched against the destination host. Empty matches every host
+	Host string `toml:"host"`
+	// Glob matched against the destination path. Empty matches every path
+	Path string `toml:"path"`
+}
+
+type routeMatcher struct {
+	host glob.Glob
+	path glob.Glob
+}
+
+func (rt route) validate() error {
+	_, err := newRouteMatcher(rt)
+	return err
+}
+
+func newRouteMatcher(rt route) (*routeMatcher, error) {
+	host, err := glob.Compile(IfTrueElse(rt.Host == "", "*", rt.Host))
+	if err != nil {
+		return nil, fmt.Errorf("invalid host pattern %q: %w", rt.Host, err)
+	}
+	path, err := glob.Compile(IfTrueElse(rt.Path == "", "*", rt.Path))
+	if err != nil {
+		return nil, fmt.Errorf("invalid path pattern %q: %w", rt.Path, err)
+	}
+	return &routeMatcher{host: host, path: path}, nil
+}
+
+func (m *routeMatcher) match(destination *url.URL) bool {
+	return m.host.Match(destination.Host) && m.path.Match(IfTrueElse(destination.Path == "", "/", destination.Path))
+}
@@ -1,20 +1,19 @@
 package rproxy
 
 import (
-	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/NYTimes/gziphandler"
 	"github.com/gobwas/glob"
-	"github.com/rs/cors"
 	"github.com/samber/lo"
 )
 
@@ -27,17 +26,54 @@ type handler struct {
 	allowedMethods  []string
 	allowedHosts    []string
 	disallowedHosts []string
-
-	// When this is set to `true` it won't pass any CORS requests to the underlying server, rather the proxy will handle
-	// all requests in the "unsafe" mode, meaning, it will allow everything. That's useful for debugging purposes but
-	// not recommended in production
-	unsafeCORS bool
+	allowedPaths    []*compiledPathRule
+	deniedPaths     []*compiledPathRule
+	clientCertRules []clientCertRule
 
 	// Limits
 	maxRequestSizeInKb  uint64
 	maxResponseSizeInKb uint64
+	timeout             time.Duration
+
+	policies []compiledPolicy
+
+	requestHeaders  headerRules
+	responseHeaders headerRules
+	// Headers of the destination responses passed through to the clients
+	passThroughPatterns       []glob.Glob
+	originalContentTypeHeader string
+	// Compresses the plaintext of encrypted responses when set
+	compression *compression
+
+	ipResolver *ipResolver
+	forwarding forwarding
+
+	jwtVerifier *jwtVerifier
+	apiKeys     map[string]*compiledAPIKey
+
+	originRules []*compiledOriginRule
+
+	rateLimits     []compiledRateLimit
+	rateLimitStore RateLimitStore
+	quotas         *quotas
+	quotaStore     *fileQuotaStore
+
+	admin *admin
 
 	httpClient *http.Client
+	// Clients for the destinations that have their own settings
+	upstreamClients []upstreamClient
+}
+
+// HandlerOption is for customizing the parts of the handler that can't be expressed through the config
+type HandlerOption func(h *handler)
+
+// WithRateLimitStore is for keeping the rate limits in a store other than memory, such as one shared among all the
+// instances of the proxy
+func WithRateLimitStore(store RateLimitStore) HandlerOption {
+	return func(h *handler) {
+		h.rateLimitStore = store
+	}
 }
 
 type middlewareFunc func(next http.Handler) http.Handler
@@ -51,7 +87,55 @@ func withMiddlewares(handler http.Handler, middlewares []middlewareFunc) http.Ha
 }
 
 // NewHandler is for creating a new handler
-func NewHandler(cfg *Config) http.Handler {
+func NewHandler(cfg *Config, opts ...HandlerOption) (http.Handler, error) {
+	upstreamClients, err := makeUpstreamClients(cfg)
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := parseTrustedProxies(cfg.General.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	passThroughPatterns, err := compileHeaderPatterns(cfg.Headers.passThrough())
+	if err != nil {
+		return nil, err
+	}
+	allowedPaths, err := compilePathRules(cfg.PathRules.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deniedPaths, err := compilePathRules(cfg.PathRules.Deny)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := compilePolicies(cfg.Policies)
+	if err != nil {
+		return nil, err
+	}
+	originRules, err := compileOriginRules(cfg.OriginRules)
+	if err != nil {
+		return nil, err
+	}
+	rateLimits, err := compileRateLimits(cfg.RateLimits)
+	if err != nil {
+		return nil, err
+	}
+	var jwtVerifier *jwtVerifier
+	if cfg.JWT != nil {
+		if jwtVerifier, err = newJWTVerifier(cfg.JWT); err != nil {
+			return nil, err
+		}
+	}
+	apiKeys, err := compileAPIKeys(cfg.APIKeys)
+	if err != nil {
+		return nil, err
+	}
+	var quotaStore *fileQuotaStore
+	if cfg.Quotas != nil {
+		if quotaStore, err = openQuotaStore(cfg.Quotas.StoreFile); err != nil {
+			return nil, err
+		}
+	}
 
 	proxy := &handler{
 		sharedKey:             strings.TrimSpace(cfg.General.SharedKey),
@@ -61,69 +145,92 @@ func NewHandler(cfg *Config) http.Handler {
 		allowedMethods:  cfg.General.AllowedMethods,
 		allowedHosts:    cfg.General.AllowedHosts,
 		disallowedHosts: cfg.General.DisallowedHosts,
-
-		unsafeCORS: cfg.General.UnsafeCORS,
+		allowedPaths:    allowedPaths,
+		deniedPaths:     deniedPaths,
+		clientCertRules: cfg.ClientCertRules,
 
 		maxRequestSizeInKb:  cfg.Limits.MaxRequestSizeInKB,
 		maxResponseSizeInKb: cfg.Limits.MaxResponseSizeInKB,
+		timeout:             seconds(cfg.Timeouts.ClientTimeout),
+
+		policies: policies,
+
+		requestHeaders:  cfg.Headers.Request,
+		responseHeaders: cfg.Headers.Response,
+
+		passThroughPatterns:       passThroughPatterns,
+		originalContentTypeHeader: cfg.Headers.originalContentTypeHeader(),
+		compression:               cfg.Compression,
+
+		ipResolver: newIPResolver(trustedProxies, cfg.General.ClientIPHeader),
+		forwarding: cfg.Forwarding,
 
-		httpClient: makeClientFromConfig(cfg),
+		jwtVerifier: jwtVerifier,
+		apiKeys:     apiKeys,
+
+		originRules: originRules,
+
+		rateLimits:     rateLimits,
+		rateLimitStore: NewMemoryRateLimitStore(),
+		quotas:         cfg.Quotas,
+		quotaStore:     quotaStore,
+
+		admin: cfg.Admin,
+
+		httpClient:      makeClientFromConfig(cfg, nil),
+		upstreamClients: upstreamClients,
+	}
+
+	for _, opt := range opts {
+		opt(proxy)
 	}
 
 	defaultMiddlewares := []middlewareFunc{
+		proxy.withOriginRules,
+		proxy.withAdmin,
 		logIncomingRequest,
 		dodgeFaviconRequest,
-		gziphandler.GzipHandler,
-	}
-
-	// Configure CORS if necessary
-	if cfg.CORS != nil {
-		return withMiddlewares(
-			proxy,
-			append(defaultMiddlewares, cors.New(cors.Options{
-				AllowCredentials: cfg.CORS.AllowCredentials,
-				AllowedHeaders:   cfg.CORS.AllowedHeaders,
-				AllowedMethods:   cfg.CORS.AllowedMethods,
-				AllowedOrigins:   cfg.CORS.AllowedOrigins,
-				ExposedHeaders:   cfg.CORS.ExposedHeaders,
-				MaxAge:           cfg.CORS.MaxAge,
-			}).Handler),
-		)
-	} else if cfg.General.UnsafeCORS {
-		return withMiddlewares(
-			proxy,
-			append(defaultMiddlewares, cors.AllowAll().Handler),
-		)
+		proxy.withCompression,
+		proxy.withPolicy,
+	}
+
+	// CORS answers preflight requests on its own, so they never reach the destinations
+	withCORS, err := newCORS(cfg)
+	if err != nil {
+		return nil, err
 	}
+	middlewares := append(defaultMiddlewares, withCORS)
+
+	// The client IP is resolved before anything else since most middlewares depend on it, and so is the identity of the
+	// user, which is logged along with the request
+	middlewares = append(middlewares, proxy.withIdentity, withRealIP(proxy.ipResolver))
 
-	return withMiddlewares(proxy, defaultMiddlewares)
+	return withMiddlewares(proxy, middlewares), nil
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Not implemented yet
-	// if h.unsafeCORS {
-	// 	if r.Method == http.MethodOptions {
-	// 		w.WriteHeader(http.StatusNoContent)
-	// 		return
-	// 	}
-	// }
-
 	w.Header().Set(h.isEncryptedHeaderKey, "false")
+	// Parse the incoming URL being proxied
+	proxyToURL, err := requestURIToProxyURL(r.RequestURI)
+	if proxyToURL == nil || err != nil || proxyToURL.Scheme == "" || proxyToURL.Host == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Couldn't proxy the request due to invalid request URI: %q", r.RequestURI)
+		return
+	}
+	// Find out the settings that apply to the destination
+	policy, _ := h.requestPolicy(r)
 	// Verify if the method we're requesting the destination with is allowed
-	if !lo.Contains(h.allowedMethods, r.Method) {
+	if !lo.Contains(policy.allowedMethods, r.Method) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		log.Printf(
 			"Couldn't proxy the request to the destination since the provided method is not allowed. Wanted: %s. Got: %q",
-			strings.Join(h.allowedMethods, ", "),
+			strings.Join(policy.allowedMethods, ", "),
 			r.Method,
 		)
 		return
 	}
-	// Parse the incoming URL being proxied
-	proxyToURL, err := requestURIToProxyURL(r.RequestURI)
-	if proxyToURL == nil || err != nil || proxyToURL.Scheme == "" || proxyToURL.Host == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("Couldn't proxy the request due to invalid request URI: %q", r.RequestURI)
+	// Verify the credentials that came with the request, if we're checking them
+	if !h.requireAuthentication(w, r) {
 		return
 	}
 	// Verify if the "Host" we're proxying to is blacklisted. This is primarly useful to avoid recursive proxying
@@ -139,14 +246,58 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Rebuilds from scratch the URL we're proxying to
-	destinationURL := fmt.Sprintf("%s://%s%s", proxyToURL.Scheme, proxyToURL.Host, proxyToURL.Path)
+	// Verify if the path we're proxying to can be reached
+	if !h.isPathAllowed(r.Method, proxyToURL) {
+		w.WriteHeader(http.StatusForbidden)
+		log.Printf("Denying %q request to Host: %q and Path: %q", r.Method, proxyToURL.Host, proxyToURL.Path)
+		return
+	}
+
+	// Verify if the client is allowed to reach the "Host" based on its certificate
+	if !h.isClientCertAllowed(r, proxyToURL.Host) {
+		w.WriteHeader(http.StatusForbidden)
+		log.Printf("Denying request to Host: %q from client certificate: %q", proxyToURL.Host, clientCertCommonName(r))
+		return
+	}
+
+	// Verify if the API key the request was made with, if any, can reach the destination
+	if !h.isAPIKeyAllowed(r, proxyToURL) {
+		w.WriteHeader(http.StatusForbidden)
+		log.Printf("Denying %q request to %q with the API key of %q", r.Method, proxyToURL, requestIdentity(r).user)
+		return
+	}
+
+	// Verify if the client hasn't gone over the rate limits of the destination
+	if !h.allowRate(w, r, proxyToURL) {
+		return
+	}
+	// Verify if the user still has quota left
+	if !h.allowQuota(w, r) {
+		return
+	}
+
+	// Rebuilds from scratch the URL we're proxying to, with the same path the rules were checked against, so the
+	// destination can't be reached with a path that decodes into something the rules never saw. The query string is
+	// kept as it came, except for the spaces that unencoded destinations end up with once decoded
+	destinationURL := (&url.URL{
+		Scheme:   proxyToURL.Scheme,
+		Host:     proxyToURL.Host,
+		Path:     normalizedPath(proxyToURL.Path),
+		RawQuery: strings.ReplaceAll(proxyToURL.RawQuery, " ", "%20"),
+	}).String()
 	log.Printf("Sending a %q request to %q", r.Method, destinationURL)
-	preq, err := http.NewRequest(
+	ctx := r.Context()
+	if policy.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.timeout)
+		defer cancel()
+	}
+	preq, err := http.NewRequestWithContext(
+		ctx,
 		r.Method,
 		destinationURL,
 		// Limit the amount of data we read from the request before passing it to the destination
-		io.LimitReader(r.Body, int64(h.maxRequestSizeInKb)*1024),
+		io.LimitReader(r.Body, int64(policy.maxRequestSizeInKb)*1024),
 	)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -160,31 +311,30 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// http: Request.RequestURI can't be set in client requests
 	// https://go.dev/src/net/http/client.go
 	preq.RequestURI = ""
-	h.copyHeaders(preq.Header, r.Header)
+	vars := headerTemplateVars(r, requestID(r), policy.name, proxyToURL.Host)
+	policy.requestHeaders.copy(preq.Header, r.Header)
 	h.delHopHeaders(preq.Header)
+	// API keys are credentials for the proxy only, so they never reach the destinations whatever the header rules are.
+	// Rules setting the header explicitly still apply, since the value then comes from the config
+	preq.Header.Del(hXAPIKey)
+	policy.requestHeaders.rewrite(preq.Header, vars)
 	if h.sharedKeyOriginHeader != "" {
 		preq.Header.Set(h.sharedKeyOriginHeader, h.sharedKey)
 	}
 
-	forwardedFor := realIP(r)
-	// If we aren't the first proxy retain prior X-Forwarded-For information as a comma+space separated list and fold
-	// multiple headers into one
-	// if prior, ok := preq.Header[hXForwardedFor]; ok {
-	// 	forwardedFor = strings.Join(prior, ", ") + ", " + forwardedFor
-	// }
-	// preq.Header.Set(hXForwardedFor, forwardedFor)
+	h.setForwardingHeaders(preq, r)
 
 	// Provide context information for logging
 	logDetailsLine := fmt.Sprintf(
 		"%s %s %q %s %q",
-		forwardedFor,
+		realIP(r),
 		r.Method,
 		proxyToURL,
 		r.Proto,
 		r.UserAgent(),
 	)
 
-	pres, err := h.httpClient.Do(preq)
+	pres, err := h.clientFor(proxyToURL.Host).Do(preq)
 	if err != nil {
 		if pres != nil {
 			w.WriteHeader(pres.StatusCode)
@@ -212,43 +362,57 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Handle OPTIONS method
 	if r.Method == http.MethodOptions {
-		h.copyHeaders(w.Header(), pres.Header)
+		policy.responseHeaders.copy(w.Header(), pres.Header)
+		policy.responseHeaders.rewrite(w.Header(), vars)
 		w.WriteHeader(pres.StatusCode)
 		// Don't even need to copy the body
 		return
 	}
 
-	brd := io.LimitReader(pres.Body, int64(h.maxResponseSizeInKb*1024))
-	if pres.Header.Get(http.CanonicalHeaderKey(hContentEncoding)) == "gzip" {
-		if gzr, err := gzip.NewReader(brd); gzr != nil && err == nil {
-			defer gzr.Close()
-			brd = gzr
-		}
+	maxResponseSize := int64(policy.maxResponseSizeInKb * 1024)
+	encodings := contentEncodings(pres.Header.Values(hContentEncoding))
+	if hasNoBody(r.Method, pres.StatusCode) {
+		encodings = nil
 	}
-
-	body, err := ioutil.ReadAll(brd)
+	body, err := decodeBody(io.LimitReader(pres.Body, maxResponseSize), encodings, maxResponseSize)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadGateway)
+		log.Printf("Couldn't decode the response: %s %v", logDetailsLine, err)
 		return
 	}
 
-	// Handle encryption
-	authorization := strings.TrimSpace(r.Header.Get(hAuthorization))
-	key := aesKey(authorization + h.sharedKey)
-	erb, err := aesEncrypt(key, body)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Couldn't encrypt response: %s %v", logDetailsLine, err)
-		return
+	// Some destinations, such as public assets, aren't worth encrypting
+	payload := body
+	if policy.encrypt {
+		erb, err := h.encrypt(encryptionKeyMaterial(r), body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Couldn't encrypt response: %s %v", logDetailsLine, err)
+			return
+		}
+		payload = erb
 	}
 
-	// We're ready to start transfering the encrypted response
-	w.Header().Set(hContentLength, strconv.Itoa(len(erb)))
-	w.Header().Set(h.isEncryptedHeaderKey, "true")
+	h.passThroughHeaders(w.Header(), pres.Header, policy.responseHeaders)
+	if policy.encrypt {
+		// The encrypted payload is binary, so the original type is sent along for clients to make sense of it once it's
+		// decrypted
+		if contentType := w.Header().Get(hContentType); contentType != "" {
+			w.Header().Set(h.originalContentTypeHeader, contentType)
+		}
+		w.Header().Set(hContentType, "application/octet-stream")
+		w.Header().Set(h.isEncryptedHeaderKey, "true")
+		// The payload depends on the credentials of the caller, so shared caches must not serve it to anyone else
+		w.Header().Add(hVary, hAuthorization)
+		w.Header().Add(hVary, hXAPIKey)
+	}
+	policy.responseHeaders.rewrite(w.Header(), vars)
+
+	// We're ready to start transfering the response
+	w.Header().Set(hContentLength, strconv.Itoa(len(payload)))
 	w.WriteHeader(pres.StatusCode)
-	w.Write(erb)
-	return
+	w.Write(payload)
+	h.recordQuotaBytes(r, len(payload))
 }
 
 // Hop-by-hop headers. These are removed when sent to the backend
@@ -274,36 +438,43 @@ func (h *handler) isHostInGlobList(hosts []string, candidate string) bool {
 	return false
 }
 
-func (h *handler) delHopHeaders(header http.Header) {
-	for _, h := range hopHeaders {
-		header.Del(h)
+// isClientCertAllowed is for checking the client certificate against all the rules covering the host
+func (h *handler) isClientCertAllowed(r *http.Request, host string) bool {
+	commonName := clientCertCommonName(r)
+	for _, rule := range h.clientCertRules {
+		if !h.isHostInGlobList(rule.Hosts, host) {
+			continue
+		}
+		if commonName == "" || !h.isHostInGlobList(rule.CommonNames, commonName) {
+			return false
+		}
 	}
+	return true
 }
 
-func (h *handler) copyHeaders(dst, src http.Header) {
-	for k, vv := range src {
-		for _, v := range vv {
-			dst.Add(k, v)
-		}
+func (h *handler) delHopHeaders(header http.Header) {
+	for _, h := range hopHeaders {
+		header.Del(h)
 	}
 }
 
-func makeClientFromConfig(cfg *Config) *http.Client {
+func makeClientFromConfig(cfg *Config, tlsConfig *tls.Config) *http.Client {
 	return &http.Client{
 		Transport: &http.Transport{
 			Dial: (&net.Dialer{
-				Timeout:   time.Duration(cfg.Timeouts.DialerTimeout * uint32(time.Second)),
+				Timeout:   seconds(cfg.Timeouts.DialerTimeout),
 				KeepAlive: 30 * time.Second,
 			}).Dial,
 			ForceAttemptHTTP2:      true,
+			TLSClientConfig:        tlsConfig,
 			MaxIdleConns:           cfg.Limits.MaxIdleConns,
 			MaxIdleConnsPerHost:    cfg.Limits.MaxIdleConnsPerHost,
 			MaxConnsPerHost:        cfg.Limits.MaxConnsPerHost,
 			MaxResponseHeaderBytes: int64(cfg.Limits.MaxResponseHeaderInKB * 1024),
-			TLSHandshakeTimeout:    time.Duration(cfg.Timeouts.TLSHandshakeTimeout * uint32(time.Second)),
-			ResponseHeaderTimeout:  time.Duration(cfg.Timeouts.ResponseHeaderTimeout * uint32(time.Second)),
-			ExpectContinueTimeout:  time.Duration(cfg.Timeouts.ExpectContinueTimeout * uint32(time.Second)),
-			IdleConnTimeout:        time.Duration(cfg.Timeouts.IdleConnTimeout * uint32(time.Second)),
+			TLSHandshakeTimeout:    seconds(cfg.Timeouts.TLSHandshakeTimeout),
+			ResponseHeaderTimeout:  seconds(cfg.Timeouts.ResponseHeaderTimeout),
+			ExpectContinueTimeout:  seconds(cfg.Timeouts.ExpectContinueTimeout),
+			IdleConnTimeout:        seconds(cfg.Timeouts.IdleConnTimeout),
 			DisableCompression:     true,
 		},
 	}
@@ -0,0 +1,165 @@
+package rproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Server is the standalone server. Besides applying the server-side timeouts, it answers the readiness checks, handles
+// TLS termination and knows how to shut down gracefully, draining in-flight requests before exiting
+type Server struct {
+	httpServer      *http.Server
+	readinessPath   string
+	drainPeriod     time.Duration
+	shutdownTimeout time.Duration
+	// Is set to 1 once the shutdown begins
+	draining int32
+
+	// TLS
+	tlsConfig         *tls.Config
+	certificates      *certificateStore
+	watchCerts        bool
+	redirectListen    string
+	redirectServer    *http.Server
+	stopWatchingCerts context.CancelFunc
+}
+
+// NewServer is for creating the standalone server that will serve the given handler
+func NewServer(cfg *Config, handler http.Handler) (*Server, error) {
+	s := &Server{
+		readinessPath:     cfg.General.ReadinessPath,
+		drainPeriod:       seconds(cfg.Timeouts.ShutdownDrainPeriod),
+		shutdownTimeout:   seconds(cfg.Timeouts.ShutdownTimeout),
+		stopWatchingCerts: func() {},
+	}
+	s.httpServer = &http.Server{
+		Handler:           s.withReadiness(handler),
+		ReadHeaderTimeout: seconds(cfg.Timeouts.ReadHeaderTimeout),
+		ReadTimeout:       seconds(cfg.Timeouts.ReadTimeout),
+		WriteTimeout:      seconds(cfg.Timeouts.WriteTimeout),
+		IdleTimeout:       seconds(cfg.Timeouts.IdleTimeout),
+	}
+
+	if cfg.TLS != nil {
+		tlsConfig, certificates, err := newServerTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		s.tlsConfig = tlsConfig
+		s.certificates = certificates
+		s.watchCerts = cfg.TLS.WatchCertificates
+		s.redirectListen = cfg.TLS.RedirectListen
+		s.httpServer.TLSConfig = tlsConfig
+	}
+	return s, nil
+}
+
+// IsTLS tells whether the server terminates TLS
+func (s *Server) IsTLS() bool {
+	return s.tlsConfig != nil
+}
+
+// Serve accepts incoming connections on the listener. After Shutdown is called it returns http.ErrServerClosed
+func (s *Server) Serve(l net.Listener) error {
+	if !s.IsTLS() {
+		return s.httpServer.Serve(l)
+	}
+
+	if s.watchCerts {
+		var ctx context.Context
+		ctx, s.stopWatchingCerts = context.WithCancel(context.Background())
+		go s.certificates.watch(ctx)
+	}
+	if s.redirectListen != "" {
+		if err := s.serveRedirect(l.Addr()); err != nil {
+			return err
+		}
+	}
+	// The certificates come from the TLS config
+	return s.httpServer.ServeTLS(l, "", "")
+}
+
+// Shutdown fails the readiness check, keeps serving requests for the drain period and then stops accepting new
+// connections, waiting up to the shutdown timeout for in-flight requests to finish. Connections that are still active
+// after that are closed
+func (s *Server) Shutdown() error {
+	atomic.StoreInt32(&s.draining, 1)
+	if s.drainPeriod > 0 {
+		log.Printf("Draining for %s before shutting down", s.drainPeriod)
+		time.Sleep(s.drainPeriod)
+	}
+
+	s.stopWatchingCerts()
+	ctx := context.Background()
+	if s.shutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.shutdownTimeout)
+		defer cancel()
+	}
+	if s.redirectServer != nil {
+		s.redirectServer.Shutdown(ctx)
+	}
+	log.Println("Waiting for in-flight requests to finish")
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		s.httpServer.Close()
+		return err
+	}
+	return nil
+}
+
+// serveRedirect is for starting the plain HTTP listener that redirects everything to the TLS one
+func (s *Server) serveRedirect(tlsAddr net.Addr) error {
+	l, err := net.Listen("tcp", s.redirectListen)
+	if err != nil {
+		return err
+	}
+
+	port := ""
+	if tcpAddr, ok := tlsAddr.(*net.TCPAddr); ok && tcpAddr.Port != 443 {
+		port = fmt.Sprintf(":%d", tcpAddr.Port)
+	}
+	s.redirectServer = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = h
+			}
+			http.Redirect(w, r, "https://"+host+port+r.RequestURI, http.StatusPermanentRedirect)
+		}),
+		ReadHeaderTimeout: s.httpServer.ReadHeaderTimeout,
+		IdleTimeout:       s.httpServer.IdleTimeout,
+	}
+
+	log.Printf("Redirecting HTTP requests on %s to HTTPS", l.Addr())
+	go func() {
+		if err := s.redirectServer.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("The HTTP to HTTPS redirect listener stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// withReadiness is for answering the readiness checks before anything else, so they don't get proxied nor logged
+func (s *Server) withReadiness(next http.Handler) http.Handler {
+	if s.readinessPath == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != s.readinessPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if atomic.LoadInt32(&s.draining) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
@@ -0,0 +1,109 @@
+package rproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// servePlain is for serving the handler through the standalone server without TLS, returning its base URL
+func servePlain(t *testing.T, cfg *Config, handler http.Handler) (*Server, string) {
+	t.Helper()
+	srv, err := NewServer(cfg, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.httpServer.Close() })
+	return srv, "http://" + l.Addr().String()
+}
+
+func statusOf(t *testing.T, url string) int {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	return res.StatusCode
+}
+
+func TestShutdownDrainPeriod(t *testing.T) {
+	cfg := &Config{General: general{ReadinessPath: "/ready"}, Timeouts: timeouts{ShutdownDrainPeriod: 1}}
+	srv, url := servePlain(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	if code := statusOf(t, url+"/ready"); code != http.StatusOK {
+		t.Fatalf("expected to be ready, got %d", code)
+	}
+
+	shutdown := make(chan error, 1)
+	start := time.Now()
+	go func() { shutdown <- srv.Shutdown() }()
+	time.Sleep(100 * time.Millisecond)
+
+	// While draining, the readiness check fails but requests are still served
+	if code := statusOf(t, url+"/ready"); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected not to be ready while draining, got %d", code)
+	}
+	if code := statusOf(t, url+"/anything"); code != http.StatusTeapot {
+		t.Fatalf("expected requests to be served while draining, got %d", code)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("expected to drain for the whole period, took %s", elapsed)
+	}
+	if _, err := http.Get(url + "/ready"); err == nil {
+		t.Fatal("expected new connections to be refused once shut down")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	cfg := &Config{Timeouts: timeouts{ShutdownTimeout: 1}}
+	srv, url := servePlain(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	inFlight := make(chan error, 1)
+	go func() {
+		res, err := http.Get(url)
+		if err == nil {
+			res.Body.Close()
+		}
+		inFlight <- err
+	}()
+	<-started
+
+	start := time.Now()
+	if err := srv.Shutdown(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the shutdown to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 3*time.Second {
+		t.Fatalf("expected to wait for the shutdown timeout, took %s", elapsed)
+	}
+	// Requests that were still in-flight get their connections closed
+	select {
+	case err := <-inFlight:
+		if err == nil {
+			t.Fatal("expected the in-flight request to be cut off")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the in-flight connection to be closed")
+	}
+}
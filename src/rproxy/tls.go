@@ -0,0 +1,181 @@
+package rproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// How often the certificate files are checked for changes when `tls.watchCertificates` is enabled
+const certificatesWatchInterval = 30 * time.Second
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":         tls.NoClientCert,
+	"none":     tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (opts *tlsOptions) validate() error {
+	if len(opts.Certificates) == 0 {
+		return errors.New("at least one certificate is required")
+	}
+	for _, cert := range opts.Certificates {
+		if cert.CertFile == "" || cert.KeyFile == "" {
+			return errors.New("certificates require both certFile and keyFile")
+		}
+	}
+	if _, err := opts.minVersion(); err != nil {
+		return err
+	}
+	if _, err := opts.cipherSuites(); err != nil {
+		return err
+	}
+	if clientAuth, ok := clientAuthTypes[opts.ClientAuth]; !ok {
+		return fmt.Errorf("unknown clientAuth %q", opts.ClientAuth)
+	} else if clientAuth != tls.NoClientCert && opts.ClientCAFile == "" {
+		return errors.New("clientCaFile is required to verify client certificates")
+	}
+	if opts.RedirectListen != "" {
+		if _, _, err := net.SplitHostPort(opts.RedirectListen); err != nil {
+			return fmt.Errorf("redirectListen: %w", err)
+		}
+	}
+	return nil
+}
+
+func (opts *tlsOptions) minVersion() (uint16, error) {
+	if opts.MinVersion == "" {
+		return tls.VersionTLS12, nil
+	}
+	version, ok := tlsVersions[opts.MinVersion]
+	if !ok {
+		return 0, fmt.Errorf("unknown minVersion %q", opts.MinVersion)
+	}
+	return version, nil
+}
+
+// cipherSuites is for resolving the cipher suite names. Only the ones considered secure by the standard library are
+// accepted
+func (opts *tlsOptions) cipherSuites() ([]uint16, error) {
+	var ids []uint16
+	for _, name := range opts.CipherSuites {
+		suite, ok := lo.Find(tls.CipherSuites(), func(suite *tls.CipherSuite) bool { return suite.Name == name })
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// newServerTLSConfig is for building the TLS config of the standalone server. The certificates are kept in a store
+// that picks the right one for each handshake and can be reloaded while the server is running
+func newServerTLSConfig(opts *tlsOptions) (*tls.Config, *certificateStore, error) {
+	minVersion, err := opts.minVersion()
+	if err != nil {
+		return nil, nil, err
+	}
+	cipherSuites, err := opts.cipherSuites()
+	if err != nil {
+		return nil, nil, err
+	}
+	store := &certificateStore{files: opts.Certificates}
+	if err := store.load(); err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		GetCertificate: store.getCertificate,
+		ClientAuth:     clientAuthTypes[opts.ClientAuth],
+	}
+	if opts.ClientCAFile != "" {
+		bundle, err := os.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(bundle) {
+			return nil, nil, fmt.Errorf("no certificates found in %q", opts.ClientCAFile)
+		}
+	}
+	return tlsConfig, store, nil
+}
+
+// clientCertCommonName returns the common name of the verified client certificate, if there's any
+func clientCertCommonName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+type certificateStore struct {
+	files        []tlsCertificate
+	mu           sync.RWMutex
+	certificates []tls.Certificate
+}
+
+// load reads all the certificates from disk. If any of them fails, the ones previously loaded are kept
+func (cs *certificateStore) load() error {
+	certificates := make([]tls.Certificate, 0, len(cs.files))
+	for _, file := range cs.files {
+		cert, err := tls.LoadX509KeyPair(file.CertFile, file.KeyFile)
+		if err != nil {
+			return fmt.Errorf("couldn't load certificate %q: %w", file.CertFile, err)
+		}
+		// Parsing the leaf upfront avoids doing it on every handshake when matching the server name
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("couldn't parse certificate %q: %w", file.CertFile, err)
+		}
+		certificates = append(certificates, cert)
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.certificates = certificates
+	return nil
+}
+
+func (cs *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for i := range cs.certificates {
+		if hello.SupportsCertificate(&cs.certificates[i]) == nil {
+			return &cs.certificates[i], nil
+		}
+	}
+	return &cs.certificates[0], nil
+}
+
+// watch reloads the certificates whenever any of their files change. It blocks until the context is done
+func (cs *certificateStore) watch(ctx context.Context) {
+	paths := lo.FlatMap(cs.files, func(file tlsCertificate, _ int) []string {
+		return []string{file.CertFile, file.KeyFile}
+	})
+	watchFiles(ctx, certificatesWatchInterval, paths, func() {
+		if err := cs.load(); err != nil {
+			log.Printf("Couldn't reload the certificates, keeping the previous ones: %v", err)
+			return
+		}
+		log.Println("Reloaded the certificates")
+	})
+}
@@ -0,0 +1,368 @@
+package rproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues the certificates used by the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rproxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue is for issuing a server certificate when DNS names are given, or a client certificate otherwise
+func (ca *testCA) issue(t *testing.T, commonName string, dnsNames ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if len(dnsNames) > 0 {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// writeCA is for writing the certificate of the CA as a PEM bundle, returning its path
+func (ca *testCA) writeCA(t *testing.T, dir string) string {
+	t.Helper()
+	path := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeCertificate is for writing the certificate and its key as PEM files named after name
+func writeCertificate(t *testing.T, dir, name string, cert tls.Certificate) tlsCertificate {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := tlsCertificate{CertFile: filepath.Join(dir, name+".pem"), KeyFile: filepath.Join(dir, name+".key")}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(files.CertFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(files.KeyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// serveTLS is for serving the handler through the standalone server built out of the config, returning its address
+func serveTLS(t *testing.T, cfg *Config, handler http.Handler) (*Server, string) {
+	t.Helper()
+	srv, err := NewServer(cfg, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.httpServer.Close() })
+	return srv, l.Addr().String()
+}
+
+func TestIsClientCertAllowed(t *testing.T) {
+	ca := newTestCA(t)
+	h := &handler{clientCertRules: []clientCertRule{{Hosts: []string{"*.internal.fundamentei.io"}, CommonNames: []string{"service-*"}}}}
+
+	tests := []struct {
+		name       string
+		host       string
+		commonName string
+		allowed    bool
+	}{
+		{"allowed common name", "api.internal.fundamentei.io", "service-reports", true},
+		{"wrong common name", "api.internal.fundamentei.io", "someone-else", false},
+		{"without certificate", "api.internal.fundamentei.io", "", false},
+		{"host not covered", "api.fundamentei.io", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/https://"+tt.host+"/json", nil)
+			if tt.commonName != "" {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{ca.issue(t, tt.commonName).Leaf, ca.cert}}}
+			}
+			if got := h.isClientCertAllowed(r, tt.host); got != tt.allowed {
+				t.Fatalf("expected allowed to be %v, got %v", tt.allowed, got)
+			}
+		})
+	}
+}
+
+func TestClientCertRulesRequireClientAuth(t *testing.T) {
+	for _, tlsOpts := range []*tlsOptions{nil, {Certificates: []tlsCertificate{{CertFile: "cert.pem", KeyFile: "key.pem"}}, ClientAuth: "none"}} {
+		cfg := &Config{
+			General:         general{IsEncryptedHeaderKey: "X-Is-Encrypted"},
+			TLS:             tlsOpts,
+			ClientCertRules: []clientCertRule{{Hosts: []string{"*"}, CommonNames: []string{"service"}}},
+		}
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("expected the rules to be rejected without client auth, with %+v", tlsOpts)
+		}
+	}
+	cfg := &Config{ClientCertRules: []clientCertRule{{Hosts: []string{"*"}}}}
+	if err := cfg.ValidateLambda(); err == nil {
+		t.Fatal("expected the rules to be rejected on AWS Lambda")
+	}
+}
+
+func TestClientCertHandshake(t *testing.T) {
+	ca, untrusted := newTestCA(t), newTestCA(t)
+	dir := t.TempDir()
+	cfg := &Config{TLS: &tlsOptions{
+		Certificates: []tlsCertificate{writeCertificate(t, dir, "server", ca.issue(t, "localhost", "localhost"))},
+		ClientAuth:   "require",
+		ClientCAFile: ca.writeCA(t, dir),
+	}}
+	_, addr := serveTLS(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, clientCertCommonName(r))
+	}))
+
+	get := func(certificates ...tls.Certificate) (string, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      ca.pool(),
+			Certificates: certificates,
+		}}}
+		res, err := client.Get("https://" + addr + "/")
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	if commonName, err := get(ca.issue(t, "service-reports")); err != nil || commonName != "service-reports" {
+		t.Fatalf("expected the certificate to be verified, got %q %v", commonName, err)
+	}
+	if _, err := get(); err == nil {
+		t.Fatal("expected the handshake to fail without a certificate")
+	}
+	if _, err := get(untrusted.issue(t, "service-reports")); err == nil {
+		t.Fatal("expected the handshake to fail with a certificate from another CA")
+	}
+}
+
+// handshake is for connecting to the server, returning the state of the connection
+func handshake(addr string, config *tls.Config) (tls.ConnectionState, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState(), nil
+}
+
+func TestCertificateSelection(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cfg := &Config{TLS: &tlsOptions{Certificates: []tlsCertificate{
+		writeCertificate(t, dir, "api", ca.issue(t, "api", "api.fundamentei.io")),
+		writeCertificate(t, dir, "app", ca.issue(t, "app", "app.fundamentei.io")),
+	}}}
+	_, addr := serveTLS(t, cfg, http.NotFoundHandler())
+
+	tests := []struct {
+		serverName string
+		expected   string
+	}{
+		{"api.fundamentei.io", "api"},
+		{"app.fundamentei.io", "app"},
+		// Falls back to the first certificate
+		{"unknown.fundamentei.io", "api"},
+	}
+	for _, tt := range tests {
+		state, err := handshake(addr, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.serverName, err)
+		}
+		if got := state.PeerCertificates[0].Subject.CommonName; got != tt.expected {
+			t.Errorf("%s: expected the %q certificate, got %q", tt.serverName, tt.expected, got)
+		}
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	files := writeCertificate(t, dir, "server", ca.issue(t, "first", "api.fundamentei.io"))
+	_, store, err := newServerTLSConfig(&tlsOptions{Certificates: []tlsCertificate{files}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() string {
+		cert, err := store.getCertificate(&tls.ClientHelloInfo{ServerName: "api.fundamentei.io"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Leaf.Subject.CommonName
+	}
+
+	writeCertificate(t, dir, "server", ca.issue(t, "renewed", "api.fundamentei.io"))
+	if err := store.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := served(); got != "renewed" {
+		t.Fatalf("expected the renewed certificate, got %q", got)
+	}
+
+	// Broken files don't replace the certificates that are being served
+	if err := os.WriteFile(files.KeyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.load(); err == nil {
+		t.Fatal("expected the broken certificate to fail to load")
+	}
+	if got := served(); got != "renewed" {
+		t.Fatalf("expected the previous certificate to be kept, got %q", got)
+	}
+}
+
+func TestTLSVersionsAndCipherSuites(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cert := writeCertificate(t, dir, "server", ca.issue(t, "server", "localhost"))
+
+	_, addr := serveTLS(t, &Config{TLS: &tlsOptions{Certificates: []tlsCertificate{cert}, MinVersion: "1.3"}}, http.NotFoundHandler())
+	if _, err := handshake(addr, &tls.Config{RootCAs: ca.pool(), ServerName: "localhost", MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Fatal("expected TLS 1.2 to be refused")
+	}
+	if state, err := handshake(addr, &tls.Config{RootCAs: ca.pool(), ServerName: "localhost"}); err != nil || state.Version != tls.VersionTLS13 {
+		t.Fatalf("expected TLS 1.3 to be negotiated, got %x %v", state.Version, err)
+	}
+
+	suite := "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"
+	_, addr = serveTLS(t, &Config{TLS: &tlsOptions{Certificates: []tlsCertificate{cert}, CipherSuites: []string{suite}}}, http.NotFoundHandler())
+	client := &tls.Config{RootCAs: ca.pool(), ServerName: "localhost", MaxVersion: tls.VersionTLS12}
+	if state, err := handshake(addr, client); err != nil || tls.CipherSuiteName(state.CipherSuite) != suite {
+		t.Fatalf("expected %s to be negotiated, got %s %v", suite, tls.CipherSuiteName(state.CipherSuite), err)
+	}
+	client.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}
+	if _, err := handshake(addr, client); err == nil {
+		t.Fatal("expected the cipher suites that weren't configured to be refused")
+	}
+
+	for _, opts := range []*tlsOptions{
+		{Certificates: []tlsCertificate{cert}, MinVersion: "1.4"},
+		{Certificates: []tlsCertificate{cert}, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+	} {
+		if err := opts.validate(); err == nil {
+			t.Errorf("expected %+v to be rejected", opts)
+		}
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	// Picks a free port for the redirect listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirectAddr := l.Addr().String()
+	l.Close()
+
+	cfg := &Config{TLS: &tlsOptions{
+		Certificates:   []tlsCertificate{writeCertificate(t, dir, "server", ca.issue(t, "server", "localhost"))},
+		RedirectListen: redirectAddr,
+	}}
+	srv, addr := serveTLS(t, cfg, http.NotFoundHandler())
+	t.Cleanup(func() {
+		if srv.redirectServer != nil {
+			srv.redirectServer.Close()
+		}
+	})
+	_, port, _ := net.SplitHostPort(addr)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	var res *http.Response
+	// The redirect listener starts along with the server, in the background
+	for i := 0; i < 50; i++ {
+		if res, err = client.Get("http://" + redirectAddr + "/https://api.fundamentei.io/v1/json?page=2"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	expected := "https://127.0.0.1:" + port + "/https://api.fundamentei.io/v1/json?page=2"
+	if res.StatusCode != http.StatusPermanentRedirect || res.Header.Get("Location") != expected {
+		t.Fatalf("expected a redirect to %q, got %d %q", expected, res.StatusCode, res.Header.Get("Location"))
+	}
+}
@@ -0,0 +1,115 @@
+package rproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gobwas/glob"
+	"github.com/samber/lo"
+)
+
+// upstreamClient is the client used to request the destinations whose host matches the glob
+type upstreamClient struct {
+	host   glob.Glob
+	client *http.Client
+}
+
+func (u *upstream) validate() error {
+	if _, err := glob.Compile(u.Host); err != nil {
+		return fmt.Errorf("invalid host pattern %q: %w", u.Host, err)
+	}
+	if (u.TLS.CertFile == "") != (u.TLS.KeyFile == "") {
+		return errors.New("tls requires both certFile and keyFile")
+	}
+	if _, err := u.TLS.pins(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// pins is for decoding the pinned hashes
+func (opts *upstreamTLS) pins() ([][]byte, error) {
+	var pins [][]byte
+	for _, encoded := range opts.PinnedSPKIHashes {
+		pin, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid pinned SPKI hash %q, expected a base64 encoded SHA-256 hash", encoded)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// makeUpstreamClients is for creating a client for each of the upstreams, since the TLS settings are per client
+func makeUpstreamClients(cfg *Config) ([]upstreamClient, error) {
+	clients := make([]upstreamClient, 0, len(cfg.Upstreams))
+	for _, u := range cfg.Upstreams {
+		tlsConfig, err := makeUpstreamTLSConfig(u.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", u.Host, err)
+		}
+		clients = append(clients, upstreamClient{
+			host:   glob.MustCompile(u.Host),
+			client: makeClientFromConfig(cfg, tlsConfig),
+		})
+	}
+	return clients, nil
+}
+
+func makeUpstreamTLSConfig(opts upstreamTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: opts.ServerName}
+
+	if opts.CAFile != "" {
+		bundle, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in %q", opts.CAFile)
+		}
+	}
+
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	pins, err := opts.pins()
+	if err != nil {
+		return nil, err
+	}
+	if len(pins) > 0 {
+		// Runs after the regular verification, so pinning only ever restricts what's accepted
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if lo.ContainsBy(pins, func(pin []byte) bool { return string(pin) == string(hash[:]) }) {
+					return nil
+				}
+			}
+			return fmt.Errorf("none of the certificates presented by %q match the pinned SPKI hashes", cs.ServerName)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// clientFor returns the client to request the given host with
+func (h *handler) clientFor(host string) *http.Client {
+	for _, u := range h.upstreamClients {
+		if u.host.Match(host) {
+			return u.client
+		}
+	}
+	return h.httpClient
+}
@@ -0,0 +1,48 @@
+package rproxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpstreamTLSPinning(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	// The test server uses a self-signed certificate, so it's its own CA
+	cert := upstream.Certificate()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(hash[:])
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	for _, tc := range []struct {
+		pins      []string
+		shouldErr bool
+	}{
+		{pins: nil, shouldErr: false},
+		{pins: []string{wrongPin, pin}, shouldErr: false},
+		{pins: []string{wrongPin}, shouldErr: true},
+	} {
+		tlsConfig, err := makeUpstreamTLSConfig(upstreamTLS{CAFile: caFile, PinnedSPKIHashes: tc.pins})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := makeClientFromConfig(&Config{}, tlsConfig).Get(upstream.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		if (err != nil) != tc.shouldErr {
+			t.Fatalf("pins %v: expected error to be %v, got %v", tc.pins, tc.shouldErr, err)
+		}
+	}
+}
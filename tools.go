@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"fundamentei.io/rproxy/src/rproxy"
+)
+
+func checkConfig(args []string) error {
+	fs := newFlagSet("check-config")
+	cfgFile := fs.String("config", "", "Path to the config file (defaults to config.toml)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, cfgPath, err := loadConfig(*cfgFile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", cfgPath, err)
+	}
+	// Building the handler and the server makes sure the files referenced by the config can be loaded as well. The quota
+	// stores opened along the way are closed right away, since nothing is served
+	handler, err := rproxy.NewHandler(cfg)
+	if closeErr := rproxy.CloseQuotaStores(); closeErr != nil {
+		log.Print(closeErr)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", cfgPath, err)
+	}
+	if _, err := rproxy.NewServer(cfg, handler); err != nil {
+		return fmt.Errorf("%s: %w", cfgPath, err)
+	}
+	warnIfMissingSharedKey(cfg)
+	fmt.Printf("%s: OK\n", cfgPath)
+	return nil
+}
+
+// cryptoFlags are the flags shared by `encrypt` and `decrypt`, which need the same key material the proxy and the asma
+// VM use
+type cryptoFlags struct {
+	fs            *flag.FlagSet
+	cfgFile       *string
+	sharedKey     *string
+	authorization *string
+	in            *string
+	out           *string
+	base64        *bool
+}
+
+func newCryptoFlags(name string) *cryptoFlags {
+	fs := newFlagSet(name)
+	return &cryptoFlags{
+		fs:            fs,
+		cfgFile:       fs.String("config", "", "Path to the config file the shared key is read from (defaults to config.toml)"),
+		sharedKey:     fs.String("shared-key", "", "Shared key to use instead of the one from the config file. Set it empty when the VM was built without one"),
+		authorization: fs.String("authorization", "", "Value of the Authorization header sent along with the request, if any. When the proxy derives the key from a JWT claim, the value of the claim"),
+		in:            fs.String("in", "-", "File to read the input from, \"-\" means stdin"),
+		out:           fs.String("out", "-", "File to write the output to, \"-\" means stdout"),
+		base64:        fs.Bool("base64", false, "Whether the encrypted payload is base64 encoded (e.g. when copied from a Lambda response)"),
+	}
+}
+
+// key returns the shared key to use. The one passed as a flag takes precedence over the one from the config file, even
+// when it's empty
+func (cf *cryptoFlags) key() (string, error) {
+	isSharedKeySet := false
+	cf.fs.Visit(func(f *flag.Flag) {
+		isSharedKeySet = isSharedKeySet || f.Name == "shared-key"
+	})
+	if isSharedKeySet {
+		return *cf.sharedKey, nil
+	}
+	cfg, _, err := loadConfig(*cf.cfgFile)
+	if err != nil {
+		return "", err
+	}
+	return cfg.General.SharedKey, nil
+}
+
+func (cf *cryptoFlags) read() ([]byte, error) {
+	if *cf.in == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(*cf.in)
+}
+
+func (cf *cryptoFlags) write(output []byte) error {
+	if *cf.out == "-" {
+		_, err := os.Stdout.Write(output)
+		return err
+	}
+	return os.WriteFile(*cf.out, output, 0o600)
+}
+
+func encrypt(args []string) error {
+	cf := newCryptoFlags("encrypt")
+	compression := cf.fs.String("compression", "", "Compresses the input with \"gzip\" or \"br\" and wraps it in an envelope, like the proxy does when compression is enabled. Use \"none\" for the envelope without compression")
+	if err := cf.fs.Parse(args); err != nil {
+		return err
+	}
+
+	sharedKey, err := cf.key()
+	if err != nil {
+		return err
+	}
+	input, err := cf.read()
+	if err != nil {
+		return err
+	}
+	var output []byte
+	if *compression != "" {
+		output, err = rproxy.EncryptCompressed(*cf.authorization, sharedKey, input, *compression)
+	} else {
+		output, err = rproxy.Encrypt(*cf.authorization, sharedKey, input)
+	}
+	if err != nil {
+		return err
+	}
+	if *cf.base64 {
+		output = []byte(base64.StdEncoding.EncodeToString(output))
+	}
+	return cf.write(output)
+}
+
+func decrypt(args []string) error {
+	cf := newCryptoFlags("decrypt")
+	maxSize := cf.fs.Int64("max-size", rproxy.DefaultMaxDecompressedSize, "How many bytes a compressed payload is allowed to decompress into")
+	if err := cf.fs.Parse(args); err != nil {
+		return err
+	}
+
+	sharedKey, err := cf.key()
+	if err != nil {
+		return err
+	}
+	input, err := cf.read()
+	if err != nil {
+		return err
+	}
+	if *cf.base64 {
+		if input, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(input))); err != nil {
+			return err
+		}
+	}
+	output, err := rproxy.DecryptWithLimit(*cf.authorization, sharedKey, input, *maxSize)
+	if err != nil {
+		return fmt.Errorf("couldn't decrypt the payload, make sure the shared key and authorization are right: %w", err)
+	}
+	return cf.write(output)
+}
+
+// keygen is for generating shared keys in the same format as the one used in the example config (a random UUID v4)
+func keygen(args []string) error {
+	fs := newFlagSet("keygen")
+	apiKey := fs.Bool("api-key", false, "Also prints the hash of the key to put in the apiKeys section of the config")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	h := hex.EncodeToString(b)
+	key := fmt.Sprintf("%s-%s-%s-%s-%s", h[0:8], h[8:12], h[12:16], h[16:20], h[20:32])
+	fmt.Println(key)
+	if *apiKey {
+		fmt.Printf("keyHash = %q\n", rproxy.HashAPIKey(key))
+	}
+	return nil
+}
+
+func printVersion(args []string) error {
+	fs := newFlagSet("version")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	fmt.Printf("rproxy %s (%s %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision", "vcs.time", "vcs.modified":
+				fmt.Printf("%s=%s\n", setting.Key, setting.Value)
+			}
+		}
+	}
+	return nil
+}